@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// envContext returns the kubeconfig context of env, empty for the current
+// context
+func envContext(env string) (string, error) {
+	context := ""
+	switch env {
+	case "":
+		return "", nil
+	case "stag":
+		context = gconfig.Stag
+	case "prod":
+		context = gconfig.Prod
+	case "dev":
+		context = gconfig.Dev
+	}
+	if context == "" {
+		return "", fmt.Errorf("no kubernetes context for env %s, try up config %s <CONTEXT>", env, env)
+	}
+	return context, nil
+}
+
+// getConfigVersion returns the version and service annotations written by
+// addVersionAnnotation
+func getConfigVersion(config *yaml.Node) (version, service string) {
+	annotations := getIn(config, "metadata.annotations")
+	return nodeString(mapGet(annotations, "version")), nodeString(mapGet(annotations, "service"))
+}
+
+// kube applies configs of deploy whose version annotation differs from the
+// live cluster, configs without namespace go to namespace ns. Returns the
+// applied configs
+func kube(k *kubeClient, deploy []byte, ns string) ([]*yaml.Node, error) {
+	configs, err := parseDocs(deploy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	applied, failed := make([]*yaml.Node, 0), 0
+	for _, config := range configs {
+		id := getResourceID(config)
+		version, service := getConfigVersion(config)
+		live, found, err := k.get(config, ns)
+		if err != nil {
+			fmt.Println(color.RedString("ERR: %s: %v", id, err))
+			failed++
+			continue
+		}
+		liveversion := live.Get("metadata.annotations.version").String()
+		if found && version != "" && liveversion == version {
+			continue
+		}
+
+		if err := k.apply(config, ns); err != nil {
+			fmt.Println(color.RedString("ERR: %s: %v", id, err))
+			failed++
+			continue
+		}
+		applied = append(applied, config)
+		if found {
+			fmt.Printf("INFO: updated %s of service %s (#%s -> #%s)\n", id, service, liveversion, version)
+		} else {
+			fmt.Printf("INFO: created %s of service %s (#%s)\n", id, service, version)
+		}
+	}
+	if failed > 0 {
+		return applied, fmt.Errorf("%d of %d configs failed to apply", failed, len(configs))
+	}
+	if len(applied) == 0 {
+		fmt.Println("INFO: all configs are up to date")
+	}
+	return applied, nil
+}
+
+func apply(c *cli.Context) error {
+	env := c.String("env")
+	if err := checkEnv(env); err != nil {
+		return cli.NewExitError(err, -80)
+	}
+	context, err := envContext(env)
+	if err != nil {
+		return cli.NewExitError(err, -80)
+	}
+
+	lockpath := deployLockPath(env)
+	deploy, err := ioutil.ReadFile(lockpath)
+	if err != nil {
+		fmt.Println(color.RedString("unable to read %s, try up merge", lockpath))
+		return cli.NewExitError(err, -81)
+	}
+
+	k, err := newKubeClient(context)
+	if err != nil {
+		return cli.NewExitError(err, -80)
+	}
+	k.forceConflicts = c.Bool("force-conflicts")
+	ns := kubeNamespace(env, k)
+	// the lock applied before this one, rolled back to if apply or rollouts fail
+	previous, err := listHistory(k, ns)
+	if err != nil {
+		return cli.NewExitError(err, -80)
+	}
+	applied, applyErr := kube(k, deploy, ns)
+	if applyErr != nil && len(applied) == 0 {
+		return cli.NewExitError(applyErr, -82)
+	}
+	// configs applied so far are live even if others failed, record them so
+	// the cluster can be rolled back from there
+	n, err := recordHistory(k, ns, deploy)
+	switch {
+	case err != nil:
+		fmt.Printf("WARN: unable to record history: %v\n", err)
+		if applyErr == nil {
+			fmt.Println(color.GreenString("%s is applied.", lockpath))
+		}
+	case applyErr != nil:
+		fmt.Println(color.RedString("ERR: %s is partially applied as #%d", lockpath, n))
+	default:
+		fmt.Println(color.GreenString("%s is applied as #%d.", lockpath, n))
+	}
+
+	timeout := c.Duration("timeout")
+	// fail rolls back to the previous lock if asked to
+	fail := func(err error, code int) error {
+		if !c.Bool("rollback") {
+			return cli.NewExitError(err, code)
+		}
+		fmt.Println(color.RedString("ERR: %v", err))
+		// the lock may be applied again, eg: after a partial failure, then
+		// it is the latest entry already
+		last, found := previousEntry(previous, n)
+		if !found {
+			return cli.NewExitError("no previous lock to roll back to", code)
+		}
+		if err := rollbackTo(k, last, ns, timeout); err != nil {
+			return cli.NewExitError(fmt.Sprintf("rollback failed: %v", err), -84)
+		}
+		return cli.NewExitError(fmt.Sprintf("apply failed, rolled back to #%d", last.N), code)
+	}
+	if applyErr != nil {
+		return fail(applyErr, -82)
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	if err := watchRollouts(k, applied, ns, timeout); err != nil {
+		return fail(err, -83)
+	}
+	return nil
+}
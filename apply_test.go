@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKubeAppliesChangedConfigs(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	s.objects["/apis/apps/v1/namespaces/default/deployments/user"] = []byte(`{"metadata": {"name": "user", "annotations": {"version": "2"}}}`)
+	s.objects["/api/v1/namespaces/default/services/user"] = []byte(`{"metadata": {"name": "user", "annotations": {"version": "1"}}}`)
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+
+	deploy := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: user
+  annotations: {version: "2", service: user}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: user
+  annotations: {version: "2", service: user}
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: user
+  annotations: {version: "2", service: user}
+`
+	if _, err := kube(k, []byte(deploy), "default"); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(s.applied) != 2 || s.applied[0] != "/api/v1/namespaces/default/services/user" || s.applied[1] != "/api/v1/namespaces/user" {
+		t.Fatalf("should apply only changed configs, got %v", s.applied)
+	}
+
+	s.applied = nil
+	if _, err := kube(k, []byte(deploy), "default"); err != nil || len(s.applied) != 0 {
+		t.Fatalf("configs are up to date, got %v %v", s.applied, err)
+	}
+
+	if _, err := kube(k, []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: user\n"), "default"); err == nil {
+		t.Fatalf("should fail on unknown kind")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+const BitbucketAPI = "https://api.bitbucket.org"
+const BitbucketWeb = "https://bitbucket.org"
+
+// Bitbucket reads repositories hosted on bitbucket.org
+type Bitbucket struct {
+	User, Pass string
+	HTTP       *httpClient
+}
+
+func (b *Bitbucket) GetLatestCommit(repo, branch string) (string, error) {
+	url := BitbucketAPI + "/2.0/repositories/" + repo + "/commits/" + branch + "?page=1&pagelen=2"
+	code, body, err := b.HTTP.get(url, b.User, b.Pass, nil)
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("request to %s not return 200, got %d", url, code)
+	}
+
+	return gjson.Get(string(body), "values.0.hash").String(), nil
+}
+
+func (b *Bitbucket) ListCommits(repo, from, to string) ([]Commit, error) {
+	url := BitbucketAPI + "/2.0/repositories/" + repo + "/commits/" + to + "?exclude=" + from + "&pagelen=" + strconv.Itoa(MaxCommits)
+	code, body, err := b.HTTP.get(url, b.User, b.Pass, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", url, code)
+	}
+
+	commits := make([]Commit, 0)
+	for _, c := range gjson.Get(string(body), "values").Array() {
+		commits = append(commits, Commit{
+			Hash:    c.Get("hash").String(),
+			Author:  c.Get("author.user.display_name").String(),
+			Message: firstLine(c.Get("message").String()),
+		})
+	}
+	return commits, nil
+}
+
+func (b *Bitbucket) GetFile(repo, commit, path string) ([]byte, error) {
+	url := BitbucketWeb + "/" + repo + "/raw/" + commit + "/" + path
+	code, body, err := b.HTTP.get(url, b.User, b.Pass, nil)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", url, code)
+	}
+	return body, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+// default max size of the fetch cache in megabytes
+const DefaultCacheSize = 100
+
+func getCacheDir() string {
+	return getHomeDir() + "/" + ConfigPath + "/cache"
+}
+
+// getCacheSize returns max size of the fetch cache in bytes
+func getCacheSize() int64 {
+	size := gconfig.CacheSize
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return size << 20
+}
+
+// cachedProvider wraps a source provider, files fetched at a commit never
+// change so they are stored on disk and served from there next time
+type cachedProvider struct {
+	SourceProvider
+	host string
+	dir  string
+}
+
+func withCache(p SourceProvider, host string) *cachedProvider {
+	return &cachedProvider{SourceProvider: p, host: host, dir: getCacheDir()}
+}
+
+// file returns path of the cache file, keyed by (host, repo, commit, path)
+func (p *cachedProvider) file(repo, commit, path string) string {
+	sum := sha256.Sum256([]byte(p.host + "\x00" + repo + "\x00" + commit + "\x00" + path))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(p.dir, key[:2], key)
+}
+
+func (p *cachedProvider) GetFile(repo, commit, path string) ([]byte, error) {
+	file := p.file(repo, commit, path)
+	if data, err := ioutil.ReadFile(file); err == nil {
+		now := time.Now()
+		os.Chtimes(file, now, now) // mark as recently used
+		return data, nil
+	}
+
+	data, err := p.SourceProvider.GetFile(repo, commit, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		fmt.Printf("WARN: unable to cache %s of repo %s: %v\n", path, repo, err)
+	}
+	return data, nil
+}
+
+// writeFileAtomic writes data to a temporary file then renames it to file, so
+// concurrent readers never see a partial file
+func writeFileAtomic(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// pruneCache removes least recently used files in dir until total size of the
+// remaining files is not greater than max, returns number of removed files and
+// freed bytes
+func pruneCache(dir string, max int64) (int, int64, error) {
+	files := make([]os.FileInfo, 0)
+	paths := make(map[os.FileInfo]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, info)
+			paths[info] = path
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// newest first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	var total, freed int64
+	removed := 0
+	for _, f := range files {
+		total += f.Size()
+		if total <= max {
+			continue
+		}
+		if err := os.Remove(paths[f]); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += f.Size()
+	}
+	return removed, freed, nil
+}
+
+func cachePrune(c *cli.Context) error {
+	max := getCacheSize()
+	if c.Bool("all") {
+		max = 0
+	}
+	removed, freed, err := pruneCache(getCacheDir(), max)
+	if err != nil {
+		return cli.NewExitError(err, -50)
+	}
+	fmt.Println(color.GreenString("removed %d files (%d KB) from %s", removed, freed>>10, getCacheDir()))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingProvider serves files from memory and counts calls to GetFile
+type countingProvider struct {
+	files map[string]string
+	calls int
+}
+
+func (p *countingProvider) GetLatestCommit(repo, branch string) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+func (p *countingProvider) GetFile(repo, commit, path string) ([]byte, error) {
+	p.calls++
+	content, ok := p.files[repo+"@"+commit+":"+path]
+	if !ok {
+		return nil, fmt.Errorf("file not found")
+	}
+	return []byte(content), nil
+}
+
+func TestCachedProvider(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+
+	p := &countingProvider{files: map[string]string{
+		"subiz/user@abc:deploy.yaml": "kind: Service\n",
+		"subiz/user@def:deploy.yaml": "kind: Deployment\n",
+	}}
+	cached := &cachedProvider{SourceProvider: p, host: "github", dir: dir}
+	for i := 0; i < 3; i++ {
+		data, err := cached.GetFile("subiz/user", "abc", "deploy.yaml")
+		if err != nil || string(data) != "kind: Service\n" {
+			t.Fatalf("wrong file, got %q %v", data, err)
+		}
+	}
+	if p.calls != 1 {
+		t.Fatalf("should fetch once, got %d", p.calls)
+	}
+
+	data, _ := cached.GetFile("subiz/user", "def", "deploy.yaml")
+	if string(data) != "kind: Deployment\n" || p.calls != 2 {
+		t.Fatalf("different commit should be fetched, got %q after %d calls", data, p.calls)
+	}
+
+	if _, err := cached.GetFile("subiz/user", "xyz", "deploy.yaml"); err == nil {
+		t.Fatalf("should return error of missing file")
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+
+	now := time.Now()
+	for i, name := range []string{"old", "mid", "new"} {
+		file := filepath.Join(dir, name[:1], name)
+		if err := writeFileAtomic(file, make([]byte, 1024)); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(file, mtime, mtime)
+	}
+
+	removed, freed, err := pruneCache(dir, 2048)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if removed != 1 || freed != 1024 {
+		t.Fatalf("should remove 1 file, got %d files %d bytes", removed, freed)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "o", "old")); !os.IsNotExist(err) {
+		t.Fatalf("oldest file should be removed")
+	}
+
+	if removed, _, _ := pruneCache(filepath.Join(dir, "missing"), 0); removed != 0 {
+		t.Fatalf("missing cache dir should be empty")
+	}
+}
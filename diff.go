@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+// serviceDiff is the change of a service between two lock files, Old is nil
+// for added services, New is nil for removed services
+type serviceDiff struct {
+	Key      string
+	Old, New *Version
+}
+
+// diffLocks returns changed services between two locks, sorted by key
+func diffLocks(oldv, newv map[string]*Version) []serviceDiff {
+	diffs := make([]serviceDiff, 0)
+	for sname, o := range oldv {
+		n := newv[sname]
+		if n != nil && o.Repo == n.Repo && o.Host == n.Host && o.Commit == n.Commit && o.Version == n.Version {
+			continue
+		}
+		diffs = append(diffs, serviceDiff{Key: sname, Old: o, New: n})
+	}
+	for sname, n := range newv {
+		if oldv[sname] == nil {
+			diffs = append(diffs, serviceDiff{Key: sname, New: n})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs
+}
+
+// resolveLatest resolves services in up.yaml to their latest commit and
+// version without touching the service cache
+func resolveLatest(h *httpClient) (map[string]*Version, error) {
+	v, err := readVersions(UpPath)
+	if err != nil {
+		return nil, err
+	}
+	for sname, sver := range v {
+		if _, _, _, err := resolveService(sver, nil, h); err != nil {
+			return nil, fmt.Errorf("service %s: %v", sname, err)
+		}
+	}
+	return v, nil
+}
+
+func printDiff(diffs []serviceDiff, withLog bool, h *httpClient) {
+	for _, d := range diffs {
+		switch {
+		case d.Old == nil:
+			fmt.Printf("%s %s %s #%s\n", color.GreenString("+"), d.Key, shortCommit(d.New.Commit), d.New.Version)
+			continue
+		case d.New == nil:
+			fmt.Printf("%s %s %s #%s\n", color.RedString("-"), d.Key, shortCommit(d.Old.Commit), d.Old.Version)
+			continue
+		}
+
+		fmt.Printf("%s %s %s #%s -> %s #%s\n", color.YellowString("~"), d.Key,
+			shortCommit(d.Old.Commit), d.Old.Version, shortCommit(d.New.Commit), d.New.Version)
+		if d.Old.Repo != d.New.Repo || d.Old.Host != d.New.Host {
+			fmt.Printf("    repo changed from %s to %s\n", d.Old.Repo, d.New.Repo)
+			continue
+		}
+		if !withLog || d.Old.Commit == d.New.Commit {
+			continue
+		}
+
+		provider, err := getProvider(d.New.Host, d.New.Repo, h)
+		if err != nil {
+			fmt.Printf("    WARN: %v\n", err)
+			continue
+		}
+		commits, err := listCommits(provider, d.New.Repo, d.Old.Commit, d.New.Commit)
+		if err != nil {
+			fmt.Printf("    WARN: %v\n", err)
+			continue
+		}
+		for _, commit := range commits {
+			fmt.Printf("    %s %s (%s)\n", color.YellowString(shortCommit(commit.Hash)), commit.Message, commit.Author)
+		}
+	}
+}
+
+func diff(c *cli.Context) error {
+	oldpath, newpath := c.Args().Get(0), c.Args().Get(1)
+	if oldpath == "" {
+		oldpath = LockPath
+	} else if newpath == "" {
+		newpath = LockPath
+	}
+
+	oldv, err := readVersions(oldpath)
+	if err != nil {
+		return cli.NewExitError(err, -60)
+	}
+
+	h := newHTTPClient(c.Int("retries"))
+	var newv map[string]*Version
+	if newpath == "" {
+		newv, err = resolveLatest(h)
+	} else {
+		newv, err = readVersions(newpath)
+	}
+	if err != nil {
+		return cli.NewExitError(err, -61)
+	}
+
+	diffs := diffLocks(oldv, newv)
+	printDiff(diffs, !c.Bool("no-log"), h)
+	fmt.Printf("%d services changed.\n", len(diffs))
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffLocks(t *testing.T) {
+	oldv := map[string]*Version{
+		"user":    {Repo: "subiz/user", Commit: "aaa", Version: "1"},
+		"account": {Repo: "subiz/account", Commit: "bbb", Version: "3"},
+		"billing": {Repo: "subiz/billing", Commit: "ccc", Version: "5"},
+	}
+	newv := map[string]*Version{
+		"user":    {Repo: "subiz/user", Commit: "ddd", Version: "2"},
+		"account": {Repo: "subiz/account", Commit: "bbb", Version: "3"},
+		"widget":  {Repo: "subiz/widget", Commit: "eee", Version: "1"},
+	}
+
+	diffs := diffLocks(oldv, newv)
+	if len(diffs) != 3 {
+		t.Fatalf("should have 3 changes, got %v", diffs)
+	}
+	if diffs[0].Key != "billing" || diffs[0].New != nil {
+		t.Fatalf("billing should be removed, got %v", diffs[0])
+	}
+	if diffs[1].Key != "user" || diffs[1].Old.Commit != "aaa" || diffs[1].New.Commit != "ddd" {
+		t.Fatalf("user should be changed, got %v", diffs[1])
+	}
+	if diffs[2].Key != "widget" || diffs[2].Old != nil {
+		t.Fatalf("widget should be added, got %v", diffs[2])
+	}
+}
+
+func TestLocalGitListCommits(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+
+	repo := makeGitRepo(t, dir, "user", map[string]string{"service.yaml": "name: user\nversion: 1\n"})
+	from := gitIn(t, repo, "rev-parse", "HEAD")
+	commitFiles(t, repo, map[string]string{"service.yaml": "name: user\nversion: 2\n"})
+	commitFiles(t, repo, map[string]string{"service.yaml": "name: user\nversion: 3\n"})
+	to := gitIn(t, repo, "rev-parse", "HEAD")
+
+	commits, err := listCommits(&LocalGit{}, repo, from, to)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(commits) != 2 || commits[0].Hash != to || commits[0].Message != "update" || commits[0].Author != "up" {
+		t.Fatalf("should list 2 commits newest first, got %v", commits)
+	}
+
+	if _, err := listCommits(&countingProvider{}, repo, from, to); err == nil {
+		t.Fatalf("should return error for provider which cannot list commits")
+	}
+}
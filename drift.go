@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+// apiKind is a kind in an api version, eg: apps/v1 Deployment
+type apiKind struct {
+	APIVersion, Kind string
+}
+
+// findDrifts compares configs of deploy with the live cluster, returns sorted
+// problems: configs whose version or service annotations differ, configs
+// missing in the cluster and configs managed by up which are not in deploy.
+// Configs without namespace are in namespace ns
+func findDrifts(k *kubeClient, deploy []byte, ns string) ([]string, error) {
+	configs, err := parseDocs(deploy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	problems := make([]string, 0)
+	locked := make(map[string]bool)
+	// kinds of configs, their namespaces are searched for unlocked configs
+	kinds := make(map[apiKind]map[string]bool)
+	for _, config := range configs {
+		live, found, err := k.get(config, ns)
+		if err != nil {
+			return nil, err
+		}
+		id := getResourceID(config)
+		kind := apiKind{APIVersion: nodeString(mapGet(config, "apiVersion")), Kind: id.Kind}
+		r, err := k.discover(kind.APIVersion, kind.Kind)
+		if err != nil {
+			return nil, err
+		}
+		if r.Namespaced {
+			id.Namespace = id.namespace(ns)
+		} else {
+			id.Namespace = ""
+		}
+		locked[id.String()] = true
+		if kinds[kind] == nil {
+			kinds[kind] = make(map[string]bool)
+		}
+		kinds[kind][id.Namespace] = true
+
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: missing in cluster", id))
+			continue
+		}
+		version, service := getConfigVersion(config)
+		liveversion := live.Get("metadata.annotations.version").String()
+		liveservice := live.Get("metadata.annotations.service").String()
+		if liveversion != version {
+			problems = append(problems, fmt.Sprintf("%s: version is #%s in cluster, #%s in lock", id, liveversion, version))
+		}
+		if liveservice != service {
+			problems = append(problems, fmt.Sprintf("%s: service is %q in cluster, %q in lock", id, liveservice, service))
+		}
+	}
+
+	for kind, namespaces := range kinds {
+		for namespace := range namespaces {
+			items, err := k.list(kind.APIVersion, kind.Kind, namespace, ManagedByLabel+"="+FieldManager)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				id := resourceID{Kind: kind.Kind, Namespace: item.Get("metadata.namespace").String(), Name: item.Get("metadata.name").String()}
+				id.setAPIVersion(kind.APIVersion)
+				if !locked[id.String()] {
+					problems = append(problems, fmt.Sprintf("%s: managed by up but not in lock", id))
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func drift(c *cli.Context) error {
+	env := c.String("env")
+	if err := checkEnv(env); err != nil {
+		return cli.NewExitError(err, -90)
+	}
+	context, err := envContext(env)
+	if err != nil {
+		return cli.NewExitError(err, -90)
+	}
+	lockpath := deployLockPath(env)
+	deploy, err := ioutil.ReadFile(lockpath)
+	if err != nil {
+		fmt.Println(color.RedString("unable to read %s, try up merge", lockpath))
+		return cli.NewExitError(err, -90)
+	}
+	k, err := newKubeClient(context)
+	if err != nil {
+		return cli.NewExitError(err, -90)
+	}
+
+	problems, err := findDrifts(k, deploy, kubeNamespace(env, k))
+	if err != nil {
+		return cli.NewExitError(err, -90)
+	}
+	for _, p := range problems {
+		fmt.Println(color.YellowString("DRIFT: ") + p)
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("cluster drifted from %s, found %d problems", lockpath, len(problems)), -91)
+	}
+	fmt.Println(color.GreenString("cluster matches %s.", lockpath))
+	return nil
+}
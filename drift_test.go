@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindDrifts(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	managed := `"labels": {"app.kubernetes.io/managed-by": "up"}`
+	s.objects["/apis/apps/v1/namespaces/default/deployments/user"] = []byte(`{"metadata": {"name": "user", "namespace": "default", ` + managed + `, "annotations": {"version": "1", "service": "user"}}}`)
+	s.objects["/apis/apps/v1/namespaces/default/deployments/old"] = []byte(`{"metadata": {"name": "old", "namespace": "default", ` + managed + `}}`)
+	s.objects["/apis/apps/v1/namespaces/default/deployments/manual"] = []byte(`{"metadata": {"name": "manual", "namespace": "default"}}`)
+	s.objects["/api/v1/namespaces/user"] = []byte(`{"metadata": {"name": "user", ` + managed + `, "annotations": {"version": "2", "service": "user"}}}`)
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+
+	deploy, err := addVersionAnnotation([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: user
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: user
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: user
+`), "2", "user")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	problems, err := findDrifts(k, deploy, "default")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expect := []string{
+		"Deployment.apps/default/old: managed by up but not in lock",
+		"Deployment.apps/default/user: version is #1 in cluster, #2 in lock",
+		"Service/default/user: missing in cluster",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("expect\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(problems, "\n"))
+	}
+}
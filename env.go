@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Envs are environments which can be selected with --env, each has its own
+// entry in ~/.up/ignoreme.toml
+var Envs = []string{"stag", "prod", "dev"}
+
+// CommonOverlay is the base name of the overlay applied to every service of
+// an environment, eg: common.prod.yaml
+const CommonOverlay = "common"
+
+func checkEnv(env string) error {
+	if env == "" {
+		return nil
+	}
+	for _, e := range Envs {
+		if e == env {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown env %s, must be one of %s", env, strings.Join(Envs, ", "))
+}
+
+// deployLockPath returns the merged deployment file of env, deploy-lock.yaml
+// when no env is selected
+func deployLockPath(env string) string {
+	if env == "" {
+		return "deploy-lock.yaml"
+	}
+	return "deploy-lock." + env + ".yaml"
+}
+
+// overlayPath returns the modification file of service sname in env,
+// <sname>.yaml when no env is selected
+func overlayPath(sname, env string) string {
+	if env == "" {
+		return sname + ".yaml"
+	}
+	return sname + "." + env + ".yaml"
+}
+
+// configNamespace returns the namespace of env set by up config
+// <env>_namespace, empty if unset
+func configNamespace(env string) string {
+	switch env {
+	case "stag":
+		return gconfig.StagNamespace
+	case "prod":
+		return gconfig.ProdNamespace
+	case "dev":
+		return gconfig.DevNamespace
+	}
+	return ""
+}
+
+// envNamespace returns the default namespace of env
+func envNamespace(env string) string {
+	if ns := configNamespace(env); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// kubeNamespace returns the namespace configs without one are applied to in
+// env by k: the namespace of env, else the namespace of the kubeconfig
+// context like kubectl, else default
+func kubeNamespace(env string, k *kubeClient) string {
+	if ns := configNamespace(env); ns != "" {
+		return ns
+	}
+	if k.namespace != "" {
+		return k.namespace
+	}
+	return DefaultNamespace
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+// Gitea reads repositories hosted on a gitea server, repo is in owner/name
+// format
+type Gitea struct {
+	URL   string // base url of the gitea server, eg: https://git.subiz.net
+	Token string
+	HTTP  *httpClient
+}
+
+func newGitea(h *httpClient) (*Gitea, error) {
+	if gconfig.GiteaURL == "" {
+		return nil, fmt.Errorf("gitea_url is not configured, try up config gitea_url <URL>")
+	}
+	return &Gitea{URL: gconfig.GiteaURL, Token: gconfig.GiteaToken, HTTP: h}, nil
+}
+
+func (g *Gitea) header() map[string]string {
+	if g.Token == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "token " + g.Token}
+}
+
+func (g *Gitea) GetLatestCommit(repo, branch string) (string, error) {
+	u := g.URL + "/api/v1/repos/" + repo + "/branches/" + url.PathEscape(branch)
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	return gjson.Get(string(body), "commit.id").String(), nil
+}
+
+func (g *Gitea) ListCommits(repo, from, to string) ([]Commit, error) {
+	u := g.URL + "/api/v1/repos/" + repo + "/compare/" + from + "..." + to
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	commits := make([]Commit, 0)
+	for _, c := range gjson.Get(string(body), "commits").Array() {
+		commits = append(commits, Commit{
+			Hash:    c.Get("sha").String(),
+			Author:  c.Get("commit.author.name").String(),
+			Message: firstLine(c.Get("commit.message").String()),
+		})
+	}
+	return reverseCommits(commits), nil
+}
+
+func (g *Gitea) GetFile(repo, commit, path string) ([]byte, error) {
+	u := g.URL + "/api/v1/repos/" + repo + "/raw/" + path + "?ref=" + url.QueryEscape(commit)
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+	return body, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+const GithubAPI = "https://api.github.com"
+
+// Github reads repositories hosted on github.com or a github enterprise
+// server, repo is in owner/name format
+type Github struct {
+	URL   string // api base url, eg: https://api.github.com
+	Token string
+	HTTP  *httpClient
+}
+
+func newGithub(h *httpClient) *Github {
+	u := gconfig.GithubURL
+	if u == "" {
+		u = GithubAPI
+	}
+	return &Github{URL: u, Token: gconfig.GithubToken, HTTP: h}
+}
+
+func (g *Github) header(accept string) map[string]string {
+	header := map[string]string{"Accept": accept}
+	if g.Token != "" {
+		header["Authorization"] = "token " + g.Token
+	}
+	return header
+}
+
+func (g *Github) GetLatestCommit(repo, branch string) (string, error) {
+	u := g.URL + "/repos/" + repo + "/commits/" + url.PathEscape(branch)
+	code, body, err := g.HTTP.get(u, "", "", g.header("application/vnd.github.v3+json"))
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	return gjson.Get(string(body), "sha").String(), nil
+}
+
+func (g *Github) ListCommits(repo, from, to string) ([]Commit, error) {
+	u := g.URL + "/repos/" + repo + "/compare/" + from + "..." + to
+	code, body, err := g.HTTP.get(u, "", "", g.header("application/vnd.github.v3+json"))
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	commits := make([]Commit, 0)
+	for _, c := range gjson.Get(string(body), "commits").Array() {
+		commits = append(commits, Commit{
+			Hash:    c.Get("sha").String(),
+			Author:  c.Get("commit.author.name").String(),
+			Message: firstLine(c.Get("commit.message").String()),
+		})
+	}
+	return reverseCommits(commits), nil
+}
+
+func (g *Github) GetFile(repo, commit, path string) ([]byte, error) {
+	u := g.URL + "/repos/" + repo + "/contents/" + path + "?ref=" + url.QueryEscape(commit)
+	code, body, err := g.HTTP.get(u, "", "", g.header("application/vnd.github.v3.raw"))
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+	return body, nil
+}
+
+func tryLoginGithub() {
+	if gconfig.GithubToken == "" {
+		return
+	}
+
+	g := newGithub(newHTTPClient(DefaultHTTPRetries))
+	code, body, err := g.HTTP.get(g.URL+"/user", "", "", g.header("application/vnd.github.v3+json"))
+	if err != nil {
+		fmt.Printf("ERR: cant login to github: %v\n", err)
+		return
+	}
+	if code != 200 {
+		fmt.Printf("ERR: cant login to github, got code %d\n", code)
+		return
+	}
+
+	fmt.Printf("welcome %s.\n", gjson.Get(string(body), "login").String())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newFakeGithub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(401)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/subiz/user/commits/master":
+			w.Write([]byte(`{"sha": "f3ae4170bbe2fc4a134474b0daa207951e07a7da"}`))
+		case "/repos/subiz/user/contents/service.yaml":
+			if r.URL.Query().Get("ref") != "f3ae4170bbe2fc4a134474b0daa207951e07a7da" {
+				w.WriteHeader(404)
+				return
+			}
+			if r.Header.Get("Accept") != "application/vnd.github.v3.raw" {
+				t.Errorf("should request raw content, got accept %s", r.Header.Get("Accept"))
+			}
+			w.Write([]byte("name: user\nversion: 22\n"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestGithubProvider(t *testing.T) {
+	ts := newFakeGithub(t)
+	defer ts.Close()
+
+	g := &Github{URL: ts.URL, Token: "secret"}
+	commit, err := g.GetLatestCommit("subiz/user", "master")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if commit != "f3ae4170bbe2fc4a134474b0daa207951e07a7da" {
+		t.Fatalf("wrong commit, got %s", commit)
+	}
+
+	s, err := getService(g, "subiz/user", commit)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if s.Name != "user" || s.Version != 22 {
+		t.Fatalf("wrong service, got %v", s)
+	}
+
+	if _, err := getDeployYaml(g, "subiz/user", commit); err == nil {
+		t.Fatalf("should return error for missing file")
+	}
+
+	g.Token = "wrong"
+	if _, err := g.GetLatestCommit("subiz/user", "master"); err == nil {
+		t.Fatalf("should return error for unauthorized request")
+	}
+}
+
+func TestResolveServiceOffline(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+	defer func(c UpConfig) { gconfig = c }(gconfig)
+
+	ts := newFakeGithub(t)
+	gconfig.GithubURL, gconfig.GithubToken = ts.URL, "secret"
+	h := &httpClient{}
+	sver := &Version{Repo: "subiz/user", Host: "github", Branch: "master"}
+	if _, _, _, err := resolveService(sver, nil, h); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	ts.Close()
+
+	// host is down, service.yaml at the locked commit is in the cache
+	locked := *sver
+	sver = &Version{Repo: "subiz/user", Host: "github", Branch: "master"}
+	if _, s, _, err := resolveService(sver, &locked, h); err != nil || s.Version != 22 || sver.Commit != locked.Commit {
+		t.Fatalf("should keep the locked commit, got %v %v %s", s, err, sver.Commit)
+	}
+	if _, _, _, err := resolveService(&Version{Repo: "subiz/user", Host: "github", Branch: "dev"}, &locked, h); err == nil {
+		t.Fatalf("locked commit of another branch should not be used")
+	}
+}
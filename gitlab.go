@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+const GitlabURL = "https://gitlab.com"
+
+// Gitlab reads repositories hosted on gitlab.com or a self-hosted gitlab, repo
+// is the full project path (group/subgroup/name)
+type Gitlab struct {
+	URL   string // base url of the gitlab server, eg: https://gitlab.com
+	Token string
+	HTTP  *httpClient
+}
+
+func newGitlab(h *httpClient) *Gitlab {
+	u := gconfig.GitlabURL
+	if u == "" {
+		u = GitlabURL
+	}
+	return &Gitlab{URL: u, Token: gconfig.GitlabToken, HTTP: h}
+}
+
+func (g *Gitlab) header() map[string]string {
+	if g.Token == "" {
+		return nil
+	}
+	return map[string]string{"PRIVATE-TOKEN": g.Token}
+}
+
+// project returns api url of the project, gitlab wants the project path
+// fully encoded, including slashes
+func (g *Gitlab) project(repo string) string {
+	return g.URL + "/api/v4/projects/" + url.QueryEscape(repo)
+}
+
+func (g *Gitlab) GetLatestCommit(repo, branch string) (string, error) {
+	u := g.project(repo) + "/repository/branches/" + url.QueryEscape(branch)
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	return gjson.Get(string(body), "commit.id").String(), nil
+}
+
+func (g *Gitlab) ListCommits(repo, from, to string) ([]Commit, error) {
+	u := g.project(repo) + "/repository/compare?from=" + url.QueryEscape(from) + "&to=" + url.QueryEscape(to)
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+
+	commits := make([]Commit, 0)
+	for _, c := range gjson.Get(string(body), "commits").Array() {
+		commits = append(commits, Commit{
+			Hash:    c.Get("id").String(),
+			Author:  c.Get("author_name").String(),
+			Message: firstLine(c.Get("message").String()),
+		})
+	}
+	return reverseCommits(commits), nil
+}
+
+func (g *Gitlab) GetFile(repo, commit, path string) ([]byte, error) {
+	u := g.project(repo) + "/repository/files/" + url.QueryEscape(path) + "/raw?ref=" + url.QueryEscape(commit)
+	code, body, err := g.HTTP.get(u, "", "", g.header())
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("request to %s not return 200, got %d", u, code)
+	}
+	return body, nil
+}
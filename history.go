@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// HistoryLimit is the number of applied locks kept in a namespace
+const HistoryLimit = 20
+
+// applied locks are kept in the cluster as configmaps up-history-<N> where N
+// increases with every apply, labelled HistoryLabel, the lock is at HistoryKey
+const (
+	HistoryPrefix = "up-history-"
+	HistoryLabel  = "up-history"
+	HistoryKey    = "deploy-lock.yaml"
+)
+
+// historyEntry is a lock applied at time Time
+type historyEntry struct {
+	N    int
+	Time time.Time
+	Lock []byte
+}
+
+// historyConfigMap returns the configmap of history entry n, keeping lock
+// deploy
+func historyConfigMap(n int, deploy []byte) (*yaml.Node, error) {
+	config := &yaml.Node{}
+	err := config.Encode(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":   HistoryPrefix + strconv.Itoa(n),
+			"labels": map[string]string{HistoryLabel: "true"},
+		},
+		"data": map[string]string{HistoryKey: string(deploy)},
+	})
+	return config, err
+}
+
+// listHistory returns locks applied to namespace ns, oldest first
+func listHistory(k *kubeClient, ns string) ([]historyEntry, error) {
+	items, err := k.list("v1", "ConfigMap", ns, HistoryLabel+"=true")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]historyEntry, 0)
+	for _, item := range items {
+		n, err := strconv.Atoi(strings.TrimPrefix(item.Get("metadata.name").String(), HistoryPrefix))
+		if err != nil || n <= 0 {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339, item.Get("metadata.creationTimestamp").String())
+		lock := item.Get("data." + strings.Replace(HistoryKey, ".", `\.`, -1)).String()
+		entries = append(entries, historyEntry{N: n, Time: created, Lock: []byte(lock)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].N < entries[j].N })
+	return entries, nil
+}
+
+// findHistory returns entry number n of entries
+func findHistory(entries []historyEntry, n int) (historyEntry, error) {
+	for _, e := range entries {
+		if e.N == n {
+			return e, nil
+		}
+	}
+	return historyEntry{}, fmt.Errorf("no history entry #%d, try up history", n)
+}
+
+// previousEntry returns the latest of entries which is not entry n, the lock
+// to roll back to when applying entry n fails
+func previousEntry(entries []historyEntry, n int) (historyEntry, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].N != n {
+			return entries[i], true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// recordHistory adds applied lock deploy to the history of namespace ns unless
+// it is the latest entry already, then drops entries beyond HistoryLimit.
+// Returns number of the entry
+func recordHistory(k *kubeClient, ns string, deploy []byte) (int, error) {
+	entries, err := listHistory(k, ns)
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	if len(entries) > 0 {
+		latest := entries[len(entries)-1]
+		if bytes.Equal(latest.Lock, deploy) {
+			return latest.N, nil
+		}
+		n = latest.N + 1
+	}
+	config, err := historyConfigMap(n, deploy)
+	if err != nil {
+		return 0, err
+	}
+	if err := k.apply(config, ns); err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(entries)+1-HistoryLimit; i++ {
+		old, _ := historyConfigMap(entries[i].N, nil)
+		if err := k.remove(old, ns); err != nil {
+			fmt.Printf("WARN: unable to drop history entry #%d: %v\n", entries[i].N, err)
+		}
+	}
+	return n, nil
+}
+
+// releaseOf describes the release of lock deploy by the version annotations
+// set by up merge, eg: user#2, web#5
+func releaseOf(deploy []byte) string {
+	configs, err := parseDocs(deploy)
+	if err != nil {
+		return "invalid lock"
+	}
+	versions := make(map[string]bool)
+	for _, config := range configs {
+		version, service := getConfigVersion(config)
+		if service != "" {
+			versions[service+"#"+version] = true
+		}
+	}
+	release := make([]string, 0, len(versions))
+	for v := range versions {
+		release = append(release, v)
+	}
+	sort.Strings(release)
+	return strings.Join(release, ", ")
+}
+
+// rollbackTo re-applies history entry e to namespace ns, records it as the
+// latest entry and watches the rollouts when timeout is set
+func rollbackTo(k *kubeClient, e historyEntry, ns string, timeout time.Duration) error {
+	fmt.Printf("INFO: rolling back to #%d (%s)\n", e.N, releaseOf(e.Lock))
+	applied, err := kube(k, e.Lock, ns)
+	if err != nil && len(applied) == 0 {
+		return err
+	}
+	// a partial rollback is recorded too, the cluster runs part of it
+	if _, err := recordHistory(k, ns, e.Lock); err != nil {
+		fmt.Printf("WARN: unable to record history: %v\n", err)
+	}
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		return watchRollouts(k, applied, ns, timeout)
+	}
+	return nil
+}
+
+// historyClient returns client of the kubernetes context of env
+func historyClient(env string) (*kubeClient, error) {
+	if err := checkEnv(env); err != nil {
+		return nil, err
+	}
+	context, err := envContext(env)
+	if err != nil {
+		return nil, err
+	}
+	return newKubeClient(context)
+}
+
+func history(c *cli.Context) error {
+	env := c.String("env")
+	k, err := historyClient(env)
+	if err != nil {
+		return cli.NewExitError(err, -100)
+	}
+	entries, err := listHistory(k, kubeNamespace(env, k))
+	if err != nil {
+		return cli.NewExitError(err, -100)
+	}
+	if len(entries) == 0 {
+		fmt.Println("no lock is applied yet")
+		return nil
+	}
+	for i, e := range entries {
+		current := ""
+		if i == len(entries)-1 {
+			current = " (current)"
+		}
+		fmt.Printf("#%d\t%s\t%s%s\n", e.N, e.Time.Local().Format("2006-01-02 15:04:05"), releaseOf(e.Lock), current)
+	}
+	return nil
+}
+
+func rollback(c *cli.Context) error {
+	env := c.String("env")
+	k, err := historyClient(env)
+	if err != nil {
+		return cli.NewExitError(err, -100)
+	}
+	k.forceConflicts = c.Bool("force-conflicts")
+	ns := kubeNamespace(env, k)
+	entries, err := listHistory(k, ns)
+	if err != nil {
+		return cli.NewExitError(err, -100)
+	}
+
+	var e historyEntry
+	if to := c.Int("to"); to > 0 {
+		if e, err = findHistory(entries, to); err != nil {
+			return cli.NewExitError(err, -100)
+		}
+	} else {
+		if len(entries) < 2 {
+			return cli.NewExitError("no previous lock to roll back to, try up history", -100)
+		}
+		e = entries[len(entries)-2]
+	}
+
+	if err := rollbackTo(k, e, ns, c.Duration("timeout")); err != nil {
+		return cli.NewExitError(err, -101)
+	}
+	fmt.Println(color.GreenString("rolled back to #%d.", e.N))
+	return nil
+}
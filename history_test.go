@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testLock(version string) []byte {
+	return []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: user
+  annotations: {version: "` + version + `", service: user}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  annotations: {version: "5", service: web}
+`)
+}
+
+func TestRecordHistory(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+
+	if entries, err := listHistory(k, "prod"); err != nil || len(entries) != 0 {
+		t.Fatalf("history should be empty, got %v %v", entries, err)
+	}
+	if n, err := recordHistory(k, "prod", testLock("1")); err != nil || n != 1 {
+		t.Fatalf("should record #1, got %d %v", n, err)
+	}
+	if _, ok := s.objects["/api/v1/namespaces/prod/configmaps/up-history-1"]; !ok {
+		t.Fatalf("history should be kept as a configmap, got %v", s.objects)
+	}
+	if n, _ := recordHistory(k, "prod", testLock("1")); n != 1 {
+		t.Fatalf("same lock should not be recorded again, got #%d", n)
+	}
+	for i := 2; i <= HistoryLimit+2; i++ {
+		if n, _ := recordHistory(k, "prod", testLock(fmt.Sprint(i))); n != i {
+			t.Fatalf("should record #%d, got #%d", i, n)
+		}
+	}
+
+	entries, _ := listHistory(k, "prod")
+	if len(entries) != HistoryLimit || entries[0].N != 3 || entries[len(entries)-1].N != HistoryLimit+2 {
+		t.Fatalf("should keep the last %d entries, got %v", HistoryLimit, entries)
+	}
+	e, err := findHistory(entries, 10)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if release := releaseOf(e.Lock); release != "user#10, web#5" {
+		t.Fatalf("wrong release, got %s", release)
+	}
+	if _, err := findHistory(entries, 1); err == nil {
+		t.Fatalf("dropped entry should not be found")
+	}
+	if entries, _ := listHistory(k, "default"); len(entries) != 0 {
+		t.Fatalf("history of another namespace should be empty, got %v", entries)
+	}
+}
+
+func TestRollbackTo(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+
+	for _, version := range []string{"1", "2"} {
+		if _, err := kube(k, testLock(version), "default"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		recordHistory(k, "default", testLock(version))
+	}
+	entries, _ := listHistory(k, "default")
+	s.applied = nil
+	if err := rollbackTo(k, entries[0], "default", 0); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(s.applied) != 2 || s.applied[0] != "/apis/apps/v1/namespaces/default/deployments/user" {
+		t.Fatalf("should re-apply only the changed deployment then record history, got %v", s.applied)
+	}
+	live, _, _ := k.get(parseConfigs(t, string(testLock("1")))[0], "default")
+	if version := live.Get("metadata.annotations.version").String(); version != "1" {
+		t.Fatalf("should roll back to version 1, got %s", version)
+	}
+	if entries, _ = listHistory(k, "default"); len(entries) != 3 || entries[2].N != 3 {
+		t.Fatalf("rollback should be recorded as #3, got %v", entries)
+	}
+
+	// the service fails to apply, the deployment is rolled back anyway
+	service := "/api/v1/namespaces/default/services/web"
+	delete(s.objects, service)
+	s.conflicts[service] = true
+	if err := rollbackTo(k, entries[1], "default", 0); err == nil {
+		t.Fatalf("rollback should fail")
+	}
+	if entries, _ = listHistory(k, "default"); len(entries) != 4 || releaseOf(entries[3].Lock) != "user#2, web#5" {
+		t.Fatalf("partial rollback should be recorded as #4, got %v", entries)
+	}
+
+	// the same lock applied again is the latest entry already, it rolls
+	// back to the entry before
+	n, _ := recordHistory(k, "default", testLock("2"))
+	e, found := previousEntry(entries, n)
+	if n != 4 || !found || e.N != 3 {
+		t.Fatalf("should roll back from #4 to #3, got #%d to #%d %v", n, e.N, found)
+	}
+	delete(s.conflicts, service)
+	if err := rollbackTo(k, e, "default", 0); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if entries, _ = listHistory(k, "default"); len(entries) != 5 || releaseOf(entries[4].Lock) != "user#1, web#5" {
+		t.Fatalf("rollback should be recorded as #5, got %v", entries)
+	}
+	if _, found := previousEntry(entries[:1], entries[0].N); found {
+		t.Fatalf("the only entry has no previous one")
+	}
+}
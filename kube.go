@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldManager is the owner of fields applied by up, see kubernetes
+// server-side apply
+const FieldManager = "up"
+
+// KubeTimeout is the timeout of requests to the kubernetes api server
+const KubeTimeout = 30 * time.Second
+
+// in-cluster service account, used when there is no kubeconfig
+const ServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeConfig is the kubeconfig file of kubectl, only fields used by up
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string
+		Context struct {
+			Cluster, User, Namespace string
+		}
+	}
+	Clusters []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Username, Password    string
+			Exec                  *kubeExec `yaml:"exec"`
+			AuthProvider          *struct {
+				Name   string
+				Config map[string]string
+			} `yaml:"auth-provider"`
+		}
+	}
+}
+
+// kubeExec is an exec credential plugin of a user, eg: aws eks get-token
+type kubeExec struct {
+	APIVersion string `yaml:"apiVersion"`
+	Command    string
+	Args       []string
+	Env        []struct{ Name, Value string }
+}
+
+// kubeClient talks to the kubernetes api server of a context
+type kubeClient struct {
+	server        string
+	authorization string
+	client        *fasthttp.Client
+
+	// api resources by group/version, filled on demand
+	resources map[string][]apiResource
+
+	// take over fields owned by other field managers when applying
+	forceConflicts bool
+
+	// namespace of the context, used for configs without namespace unless
+	// the environment has its own
+	namespace string
+}
+
+type apiResource struct {
+	Name, Kind string
+	Namespaced bool
+}
+
+// getKubeConfigPaths returns the kubeconfig files like kubectl does, the
+// files of $KUBECONFIG or ~/.kube/config
+func getKubeConfigPaths() []string {
+	paths := make([]string, 0)
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		paths = append(paths, filepath.Join(getHomeDir(), ".kube", "config"))
+	}
+	return paths
+}
+
+// newKubeClient returns client of context in the kubeconfig, the current
+// context if context is empty. The kubeconfig files are merged like kubectl
+// does, missing files are skipped. The in-cluster service account is used
+// when there is no kubeconfig
+func newKubeClient(context string) (*kubeClient, error) {
+	paths := getKubeConfigPaths()
+	config, found := kubeConfig{}, false
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+		}
+		file := kubeConfig{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("wrong yaml in %s: %v", path, err)
+		}
+		file.resolvePaths(filepath.Dir(path))
+		config.merge(file)
+		found = true
+	}
+	if !found {
+		if context == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			return newInClusterClient()
+		}
+		return nil, fmt.Errorf("unable to read kubeconfig: no such file %s", strings.Join(paths, ", "))
+	}
+	return config.client(context)
+}
+
+// resolvePaths makes relative paths of a kubeconfig file relative to dir, the
+// directory of the file
+func (c *kubeConfig) resolvePaths(dir string) {
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	for i := range c.Clusters {
+		resolve(&c.Clusters[i].Cluster.CertificateAuthority)
+	}
+	for i := range c.Users {
+		user := &c.Users[i].User
+		resolve(&user.TokenFile)
+		resolve(&user.ClientCertificate)
+		resolve(&user.ClientKey)
+		// a bare command is looked up in $PATH
+		if user.Exec != nil && strings.Contains(user.Exec.Command, "/") {
+			resolve(&user.Exec.Command)
+		}
+	}
+}
+
+// merge adds contexts, clusters and users of kubeconfig file o to c, the
+// first file setting a name or the current context wins like kubectl
+func (c *kubeConfig) merge(o kubeConfig) {
+	if c.CurrentContext == "" {
+		c.CurrentContext = o.CurrentContext
+	}
+	names := make(map[string]bool)
+	for _, ctx := range c.Contexts {
+		names["context/"+ctx.Name] = true
+	}
+	for _, cl := range c.Clusters {
+		names["cluster/"+cl.Name] = true
+	}
+	for _, u := range c.Users {
+		names["user/"+u.Name] = true
+	}
+	for _, ctx := range o.Contexts {
+		if !names["context/"+ctx.Name] {
+			c.Contexts = append(c.Contexts, ctx)
+		}
+	}
+	for _, cl := range o.Clusters {
+		if !names["cluster/"+cl.Name] {
+			c.Clusters = append(c.Clusters, cl)
+		}
+	}
+	for _, u := range o.Users {
+		if !names["user/"+u.Name] {
+			c.Users = append(c.Users, u)
+		}
+	}
+}
+
+func newInClusterClient() (*kubeClient, error) {
+	token, err := ioutil.ReadFile(filepath.Join(ServiceAccountPath, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+	tlsconfig := &tls.Config{}
+	ca, err := ioutil.ReadFile(filepath.Join(ServiceAccountPath, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account ca: %v", err)
+	}
+	if tlsconfig.RootCAs, err = certPool(ca); err != nil {
+		return nil, err
+	}
+	server := "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT")
+	k := makeKubeClient(server, "Bearer "+strings.TrimSpace(string(token)), tlsconfig)
+	if ns, err := ioutil.ReadFile(filepath.Join(ServiceAccountPath, "namespace")); err == nil {
+		k.namespace = strings.TrimSpace(string(ns))
+	}
+	return k, nil
+}
+
+// client returns client of context, relative paths in the kubeconfig must be
+// resolved already
+func (c kubeConfig) client(context string) (*kubeClient, error) {
+	if context == "" {
+		context = c.CurrentContext
+	}
+	var clustername, username, namespace string
+	found := false
+	for _, ctx := range c.Contexts {
+		if ctx.Name == context {
+			clustername, username, namespace, found = ctx.Context.Cluster, ctx.Context.User, ctx.Context.Namespace, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig", context)
+	}
+
+	readData := func(data, file string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		return ioutil.ReadFile(file)
+	}
+
+	server := ""
+	tlsconfig := &tls.Config{}
+	for _, cl := range c.Clusters {
+		if cl.Name != clustername {
+			continue
+		}
+		server = strings.TrimSuffix(cl.Cluster.Server, "/")
+		tlsconfig.InsecureSkipVerify = cl.Cluster.InsecureSkipTLSVerify
+		ca, err := readData(cl.Cluster.CertificateAuthorityData, cl.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: unable to read certificate authority: %v", clustername, err)
+		}
+		if ca != nil {
+			if tlsconfig.RootCAs, err = certPool(ca); err != nil {
+				return nil, fmt.Errorf("cluster %s: %v", clustername, err)
+			}
+		}
+	}
+	if server == "" {
+		return nil, fmt.Errorf("cluster %q of context %s has no server", clustername, context)
+	}
+
+	authorization := ""
+	for _, u := range c.Users {
+		if u.Name != username {
+			continue
+		}
+		user := u.User
+		token := user.Token
+		if token == "" && user.TokenFile != "" {
+			data, err := readData("", user.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: unable to read token file: %v", username, err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if p := user.AuthProvider; p != nil {
+			// tokens cached in the kubeconfig by kubectl, the oidc
+			// provider keeps an id-token, the gcp provider an access-token
+			token = p.Config["id-token"]
+			if token == "" {
+				token = p.Config["access-token"]
+			}
+			if token == "" {
+				return nil, fmt.Errorf("user %s: auth-provider %s has no cached token, run a kubectl command first or use an exec credential plugin", username, p.Name)
+			}
+		}
+		if user.Exec != nil {
+			cred, err := user.Exec.credential()
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", username, err)
+			}
+			token = cred.Get("status.token").String()
+			if cert := cred.Get("status.clientCertificateData").String(); cert != "" {
+				user.ClientCertificateData = base64.StdEncoding.EncodeToString([]byte(cert))
+				user.ClientKeyData = base64.StdEncoding.EncodeToString([]byte(cred.Get("status.clientKeyData").String()))
+			}
+		}
+		switch {
+		case token != "":
+			authorization = "Bearer " + token
+		case user.Username != "":
+			authorization = toBasicAuth(user.Username, user.Password)
+		}
+
+		cert, err := readData(user.ClientCertificateData, user.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: unable to read client certificate: %v", username, err)
+		}
+		key, err := readData(user.ClientKeyData, user.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: unable to read client key: %v", username, err)
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", username, err)
+			}
+			tlsconfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	k := makeKubeClient(server, authorization, tlsconfig)
+	k.namespace = namespace
+	return k, nil
+}
+
+// credential runs the exec credential plugin like kubectl does, returns the
+// printed ExecCredential
+func (e *kubeExec) credential() (gjson.Result, error) {
+	cmd := exec.Command(e.Command, e.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range e.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	info := `{"apiVersion": "` + e.APIVersion + `", "kind": "ExecCredential", "spec": {"interactive": false}}`
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+info)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("exec credential plugin %s: %v: %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	cred := gjson.ParseBytes(out)
+	if cred.Get("kind").String() != "ExecCredential" {
+		return gjson.Result{}, fmt.Errorf("exec credential plugin %s: no ExecCredential printed", e.Command)
+	}
+	return cred, nil
+}
+
+func certPool(ca []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid certificate authority")
+	}
+	return pool, nil
+}
+
+func makeKubeClient(server, authorization string, tlsconfig *tls.Config) *kubeClient {
+	return &kubeClient{
+		server:        server,
+		authorization: authorization,
+		client:        &fasthttp.Client{TLSConfig: tlsconfig, DisablePathNormalizing: true},
+		resources:     make(map[string][]apiResource),
+	}
+}
+
+// do sends a request to the api server, returns status code and body
+func (k *kubeClient) do(method, path, contenttype string, body []byte) (int, []byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(k.server + path)
+	req.Header.SetMethod(method)
+	req.Header.Set("Accept", "application/json, */*")
+	req.Header.SetUserAgent("up/" + UpVersion)
+	if k.authorization != "" {
+		req.Header.Set("Authorization", k.authorization)
+	}
+	if body != nil {
+		req.Header.SetContentType(contenttype)
+		req.SetBody(body)
+	}
+
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+	if err := k.client.DoTimeout(req, res, KubeTimeout); err != nil {
+		return 0, nil, fmt.Errorf("request to %s: %v", k.server+path, err)
+	}
+	return res.StatusCode(), append([]byte(nil), res.Body()...), nil
+}
+
+// kubeError returns the error of a failed request, using message of the
+// returned kubernetes Status if any
+func kubeError(method, path string, code int, body []byte) error {
+	if message := gjson.GetBytes(body, "message").String(); message != "" {
+		return fmt.Errorf("%s %s: %d %s", method, path, code, message)
+	}
+	return fmt.Errorf("%s %s: %d %s", method, path, code, strings.TrimSpace(string(body)))
+}
+
+// groupVersionPath returns path of api group version, eg: /api/v1 for the core
+// group, /apis/apps/v1 for others
+func groupVersionPath(apiVersion string) string {
+	if strings.Contains(apiVersion, "/") {
+		return "/apis/" + apiVersion
+	}
+	return "/api/" + apiVersion
+}
+
+// discover returns the resource of kind in api version
+func (k *kubeClient) discover(apiVersion, kind string) (apiResource, error) {
+	resources, ok := k.resources[apiVersion]
+	if !ok {
+		path := groupVersionPath(apiVersion)
+		code, body, err := k.do("GET", path, "", nil)
+		if err != nil {
+			return apiResource{}, err
+		}
+		if code != 200 {
+			return apiResource{}, kubeError("GET", path, code, body)
+		}
+		for _, r := range gjson.GetBytes(body, "resources").Array() {
+			name := r.Get("name").String()
+			if strings.Contains(name, "/") { // subresource
+				continue
+			}
+			resources = append(resources, apiResource{Name: name, Kind: r.Get("kind").String(), Namespaced: r.Get("namespaced").Bool()})
+		}
+		k.resources[apiVersion] = resources
+	}
+	for _, r := range resources {
+		if r.Kind == kind {
+			return r, nil
+		}
+	}
+	return apiResource{}, fmt.Errorf("kind %s not found in %s", kind, apiVersion)
+}
+
+// resourcePath returns path of config, configs without namespace are in
+// namespace ns
+func (k *kubeClient) resourcePath(config *yaml.Node, ns string) (string, error) {
+	id := getResourceID(config)
+	apiVersion := nodeString(mapGet(config, "apiVersion"))
+	if apiVersion == "" || id.Kind == "" || id.Name == "" {
+		return "", fmt.Errorf("config %s must have apiVersion, kind and metadata.name", id)
+	}
+	r, err := k.discover(apiVersion, id.Kind)
+	if err != nil {
+		return "", err
+	}
+	path := groupVersionPath(apiVersion)
+	if r.Namespaced {
+		path += "/namespaces/" + id.namespace(ns)
+	}
+	return path + "/" + r.Name + "/" + id.Name, nil
+}
+
+// get returns the live config, found is false if it is not in the cluster
+func (k *kubeClient) get(config *yaml.Node, ns string) (live gjson.Result, found bool, err error) {
+	path, err := k.resourcePath(config, ns)
+	if err != nil {
+		return gjson.Result{}, false, err
+	}
+	code, body, err := k.do("GET", path, "", nil)
+	if err != nil {
+		return gjson.Result{}, false, err
+	}
+	if code == 404 {
+		return gjson.Result{}, false, nil
+	}
+	if code != 200 {
+		return gjson.Result{}, false, kubeError("GET", path, code, body)
+	}
+	return gjson.ParseBytes(body), true, nil
+}
+
+// list returns live configs of kind in api version matching label selector,
+// in namespace ns if kind is namespaced
+func (k *kubeClient) list(apiVersion, kind, ns, selector string) ([]gjson.Result, error) {
+	r, err := k.discover(apiVersion, kind)
+	if err != nil {
+		return nil, err
+	}
+	path := groupVersionPath(apiVersion)
+	if r.Namespaced {
+		path += "/namespaces/" + ns
+	}
+	path += "/" + r.Name + "?labelSelector=" + url.QueryEscape(selector)
+	code, body, err := k.do("GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, kubeError("GET", path, code, body)
+	}
+	return gjson.GetBytes(body, "items").Array(), nil
+}
+
+// read returns the body of GET path, eg: a list or logs of a pod
+func (k *kubeClient) read(path string) ([]byte, error) {
+	code, body, err := k.do("GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, kubeError("GET", path, code, body)
+	}
+	return body, nil
+}
+
+// remove deletes config, a config which does not exist is not an error
+func (k *kubeClient) remove(config *yaml.Node, ns string) error {
+	path, err := k.resourcePath(config, ns)
+	if err != nil {
+		return err
+	}
+	code, body, err := k.do("DELETE", path, "", nil)
+	if err != nil {
+		return err
+	}
+	if code != 200 && code != 202 && code != 404 {
+		return kubeError("DELETE", path, code, body)
+	}
+	return nil
+}
+
+// apply creates or updates config using server-side apply. Fields owned by
+// other field managers (eg: spec.replicas of an autoscaled deployment) are a
+// conflict, unless forceConflicts is set, like kubectl apply --server-side
+func (k *kubeClient) apply(config *yaml.Node, ns string) error {
+	path, err := k.resourcePath(config, ns)
+	if err != nil {
+		return err
+	}
+	body, err := marshalYAML(config)
+	if err != nil {
+		return err
+	}
+	path += "?fieldManager=" + FieldManager
+	if k.forceConflicts {
+		path += "&force=true"
+	}
+	code, res, err := k.do("PATCH", path, "application/apply-patch+yaml", body)
+	if err != nil {
+		return err
+	}
+	if code == 409 {
+		return fmt.Errorf("%v, try --force-conflicts to take over the fields", kubeError("PATCH", path, code, res))
+	}
+	if code != 200 && code != 201 {
+		return kubeError("PATCH", path, code, res)
+	}
+	return nil
+}
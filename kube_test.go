@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeKubeServer is a kubernetes api server keeping configs in memory
+type fakeKubeServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	objects   map[string][]byte // json of configs by path
+	applied   []string          // paths of applied configs
+	conflicts map[string]bool   // paths of configs with fields of other managers
+}
+
+var fakeDiscovery = map[string]string{
+	"/api/v1":       `{"resources": [{"name": "configmaps", "kind": "ConfigMap", "namespaced": true}, {"name": "services", "kind": "Service", "namespaced": true}, {"name": "services/status", "kind": "Service", "namespaced": true}, {"name": "namespaces", "kind": "Namespace", "namespaced": false}]}`,
+	"/apis/apps/v1": `{"resources": [{"name": "deployments", "kind": "Deployment", "namespaced": true}]}`,
+}
+
+func newFakeKubeServer(t *testing.T) *fakeKubeServer {
+	s := &fakeKubeServer{objects: make(map[string][]byte), conflicts: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			return
+		}
+		if discovery, ok := fakeDiscovery[r.URL.Path]; ok {
+			w.Write([]byte(discovery))
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			if selector := r.URL.Query().Get("labelSelector"); selector != "" {
+				w.Write(s.list(r.URL.Path, "metadata.labels", selector))
+				return
+			}
+			if selector := r.URL.Query().Get("fieldSelector"); selector != "" {
+				w.Write(s.list(r.URL.Path, "", selector))
+				return
+			}
+			object, ok := s.objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"kind": "Status", "message": "not found"}`))
+				return
+			}
+			w.Write(object)
+		case "DELETE":
+			if _, ok := s.objects[r.URL.Path]; !ok {
+				w.WriteHeader(404)
+				return
+			}
+			delete(s.objects, r.URL.Path)
+			w.Write([]byte(`{"kind": "Status", "status": "Success"}`))
+		case "PATCH":
+			if r.Header.Get("Content-Type") != "application/apply-patch+yaml" || r.URL.Query().Get("fieldManager") != FieldManager {
+				w.WriteHeader(415)
+				w.Write([]byte(`{"kind": "Status", "message": "not a server-side apply"}`))
+				return
+			}
+			if s.conflicts[r.URL.Path] && r.URL.Query().Get("force") != "true" {
+				w.WriteHeader(409)
+				w.Write([]byte(`{"kind": "Status", "message": "Apply failed with 1 conflict: conflict with \"hpa\": .spec.replicas"}`))
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			var config interface{}
+			if err := yaml.Unmarshal(body, &config); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			object, _ := json.Marshal(config)
+			_, exists := s.objects[r.URL.Path]
+			s.objects[r.URL.Path] = object
+			s.applied = append(s.applied, r.URL.Path)
+			if !exists {
+				w.WriteHeader(201)
+			}
+			w.Write(object)
+		}
+	}))
+	return s
+}
+
+// list returns configs in collection path matching selector key=value,...
+// keys are labels if prefix is metadata.labels, else paths of fields
+func (s *fakeKubeServer) list(path, prefix, selector string) []byte {
+	items := make([]json.RawMessage, 0)
+	for p, object := range s.objects {
+		if !strings.HasPrefix(p, path+"/") || strings.Contains(p[len(path)+1:], "/") {
+			continue
+		}
+		matches := true
+		for _, requirement := range strings.Split(selector, ",") {
+			kv := strings.SplitN(requirement, "=", 2)
+			key := kv[0]
+			if prefix != "" {
+				key = prefix + "." + strings.Replace(key, ".", "\\.", -1)
+			}
+			if gjson.GetBytes(object, key).String() != kv[1] {
+				matches = false
+			}
+		}
+		if matches {
+			items = append(items, object)
+		}
+	}
+	list, _ := json.Marshal(map[string]interface{}{"items": items})
+	return list
+}
+
+// useKubeConfig writes a kubeconfig with context test of server and points
+// KUBECONFIG to it, returns a func to restore KUBECONFIG
+func useKubeConfig(t *testing.T, dir, kubeconfig string) func() {
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0644); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	old := os.Getenv("KUBECONFIG")
+	os.Setenv("KUBECONFIG", path)
+	return func() { os.Setenv("KUBECONFIG", old) }
+}
+
+func testKubeConfig(server string) string {
+	return `
+current-context: test
+contexts:
+- name: test
+  context: {cluster: test, user: test}
+- name: prod
+  context: {cluster: prod, user: exec, namespace: production}
+- name: gke
+  context: {cluster: prod, user: gcp}
+- name: broken
+  context: {cluster: prod, user: broken}
+clusters:
+- name: test
+  cluster: {server: "` + server + `/"}
+- name: prod
+  cluster: {server: "https://prod.example.com"}
+users:
+- name: test
+  user: {tokenFile: token}
+- name: exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: ./get-token
+      env: [{name: TOKEN, value: exec-secret}]
+- name: gcp
+  user:
+    auth-provider: {name: gcp, config: {access-token: gcp-secret}}
+- name: broken
+  user:
+    exec: {command: ./missing}
+`
+}
+
+func TestNewKubeClient(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0644)
+	getToken := "#!/bin/sh\necho '{\"kind\": \"ExecCredential\", \"status\": {\"token\": \"'$TOKEN'\"}}'\n"
+	ioutil.WriteFile(filepath.Join(dir, "get-token"), []byte(getToken), 0755)
+	defer useKubeConfig(t, dir, testKubeConfig("http://127.0.0.1:1"))()
+
+	k, err := newKubeClient("")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if k.server != "http://127.0.0.1:1" || k.authorization != "Bearer secret" {
+		t.Fatalf("wrong client of the current context, got %s %s", k.server, k.authorization)
+	}
+	if k, err := newKubeClient("prod"); err != nil || k.authorization != "Bearer exec-secret" {
+		t.Fatalf("should use token of the exec credential plugin, got %v %v", k, err)
+	}
+	defer func(c UpConfig) { gconfig = c }(gconfig)
+	if k, _ := newKubeClient("prod"); kubeNamespace("prod", k) != "production" || kubeNamespace("prod", &kubeClient{}) != DefaultNamespace {
+		t.Fatalf("configs should go to the namespace of the context, got %s", kubeNamespace("prod", k))
+	}
+	gconfig.ProdNamespace = "prod-ns"
+	if k, _ := newKubeClient("prod"); kubeNamespace("prod", k) != "prod-ns" {
+		t.Fatalf("namespace of env should win, got %s", kubeNamespace("prod", k))
+	}
+	if k, err := newKubeClient("gke"); err != nil || k.authorization != "Bearer gcp-secret" {
+		t.Fatalf("should use token cached by the auth-provider, got %v %v", k, err)
+	}
+	if _, err := newKubeClient("broken"); err == nil {
+		t.Fatalf("failed exec credential plugin should fail")
+	}
+	if _, err := newKubeClient("staging"); err == nil {
+		t.Fatalf("unknown context should fail")
+	}
+}
+
+func TestNewKubeClientMergesKubeConfigs(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0644)
+	defer useKubeConfig(t, dir, testKubeConfig("http://127.0.0.1:1"))()
+
+	// tokens of the second file are relative to its own directory
+	other := filepath.Join(dir, "other")
+	os.Mkdir(other, 0777)
+	ioutil.WriteFile(filepath.Join(other, "token"), []byte("other-secret\n"), 0644)
+	ioutil.WriteFile(filepath.Join(other, "kubeconfig"), []byte(`
+current-context: staging
+contexts:
+- name: staging
+  context: {cluster: staging, user: staging}
+- name: test
+  context: {cluster: staging, user: staging}
+clusters:
+- name: staging
+  cluster: {server: "https://staging.example.com"}
+users:
+- name: staging
+  user: {tokenFile: token}
+`), 0644)
+	os.Setenv("KUBECONFIG", strings.Join([]string{
+		filepath.Join(dir, "kubeconfig"), filepath.Join(dir, "missing"), filepath.Join(other, "kubeconfig"),
+	}, string(os.PathListSeparator)))
+
+	k, err := newKubeClient("staging")
+	if err != nil || k.server != "https://staging.example.com" || k.authorization != "Bearer other-secret" {
+		t.Fatalf("should find context of the second file, got %v %v", k, err)
+	}
+	if k, err := newKubeClient(""); err != nil || k.server != "http://127.0.0.1:1" || k.authorization != "Bearer secret" {
+		t.Fatalf("first file should win, got %v %v", k, err)
+	}
+}
+
+func TestKubeClientGetAndApply(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+
+	config, _ := parseNode("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: user\n")
+	if _, found, err := k.get(config, "prod"); err != nil || found {
+		t.Fatalf("should not be found, got %v %v", found, err)
+	}
+	if err := k.apply(config, "prod"); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	live, found, err := k.get(config, "prod")
+	if err != nil || !found || live.Get("metadata.name").String() != "user" {
+		t.Fatalf("should be found, got %v %v %v", live, found, err)
+	}
+	if s.applied[0] != "/apis/apps/v1/namespaces/prod/deployments/user" {
+		t.Fatalf("wrong path, got %s", s.applied[0])
+	}
+
+	ns, _ := parseNode("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: prod\n")
+	if err := k.apply(ns, "prod"); err != nil || s.applied[1] != "/api/v1/namespaces/prod" {
+		t.Fatalf("cluster scoped config should have no namespace, got %v %v", s.applied, err)
+	}
+
+	s.conflicts["/apis/apps/v1/namespaces/prod/deployments/user"] = true
+	if err := k.apply(config, "prod"); err == nil || !strings.Contains(err.Error(), "conflict") {
+		t.Fatalf("should fail on conflict, got %v", err)
+	}
+	k.forceConflicts = true
+	if err := k.apply(config, "prod"); err != nil {
+		t.Fatalf("should take over the fields, got %v", err)
+	}
+
+	unknown, _ := parseNode("apiVersion: v1\nkind: Pod\nmetadata:\n  name: user\n")
+	if err := k.apply(unknown, "prod"); err == nil {
+		t.Fatalf("unknown kind should fail")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// LocalGit reads repositories from the local filesystem using git itself, repo
+// is a path (or file:// url) to a working copy or a bare clone
+type LocalGit struct{}
+
+// isLocalRepo tells whether repo points to the local filesystem
+func isLocalRepo(repo string) bool {
+	return strings.HasPrefix(repo, "file://") || strings.HasPrefix(repo, "/") ||
+		strings.HasPrefix(repo, "./") || strings.HasPrefix(repo, "../")
+}
+
+func (l *LocalGit) git(repo string, args ...string) ([]byte, error) {
+	dir := strings.TrimPrefix(repo, "file://")
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s in %s: %v: %s", strings.Join(args, " "), dir, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// checkRef rejects refs which git would read as options, refs come from
+// up.yaml and up-lock.yaml
+func checkRef(refs ...string) error {
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, "-") {
+			return fmt.Errorf("invalid ref %q", ref)
+		}
+	}
+	return nil
+}
+
+func (l *LocalGit) GetLatestCommit(repo, branch string) (string, error) {
+	if branch == "" {
+		branch = "HEAD"
+	}
+	if err := checkRef(branch); err != nil {
+		return "", err
+	}
+	out, err := l.git(repo, "rev-parse", "--verify", branch+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (l *LocalGit) ListCommits(repo, from, to string) ([]Commit, error) {
+	if err := checkRef(from, to); err != nil {
+		return nil, err
+	}
+	out, err := l.git(repo, "log", "--max-count="+strconv.Itoa(MaxCommits), "--format=%H%x00%an%x00%s", from+".."+to)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]Commit, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\x00", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		commits = append(commits, Commit{Hash: fields[0], Author: fields[1], Message: fields[2]})
+	}
+	return commits, nil
+}
+
+func (l *LocalGit) GetFile(repo, commit, path string) ([]byte, error) {
+	if err := checkRef(commit); err != nil {
+		return nil, err
+	}
+	return l.git(repo, "cat-file", "blob", commit+":"+path)
+}
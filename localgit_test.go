@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// makeGitRepo creates a git repository in dir/name with files committed on
+// branch master, returns path of the repository
+func makeGitRepo(t *testing.T, dir, name string, files map[string]string) string {
+	repo := filepath.Join(dir, name)
+	if err := os.MkdirAll(repo, 0777); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	gitIn(t, repo, "init", "-q", "-b", "master")
+	commitFiles(t, repo, files)
+	return repo
+}
+
+func commitFiles(t *testing.T, repo string, files map[string]string) {
+	for path, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(repo, path), []byte(content), 0644); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	gitIn(t, repo, "add", "-A")
+	gitIn(t, repo, "-c", "user.name=up", "-c", "user.email=up@localhost", "commit", "-q", "-m", "update")
+}
+
+func gitIn(t *testing.T, dir string, args ...string) string {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// chdir changes working directory to dir, returns a func to restore it
+func chdir(t *testing.T, dir string) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return func() { os.Chdir(wd) }
+}
+
+// useHome points HOME to dir so the fetch cache and config of tests stay out
+// of the real home, returns a func to restore HOME
+func useHome(t *testing.T, dir string) func() {
+	home := os.Getenv("HOME")
+	if err := os.Setenv("HOME", dir); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return func() { os.Setenv("HOME", home) }
+}
+
+// newTestContext returns cli context of command name called with args
+func newTestContext(t *testing.T, name string, args ...string) *cli.Context {
+	cmd := newApp().Command(name)
+	if cmd == nil {
+		t.Fatalf("command %s not found", name)
+	}
+	set := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	for _, f := range cmd.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// makeTempDir creates a temporary directory, returns its path and a func to
+// remove it
+func makeTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "up")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalGitUpgradeAndMerge(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	repo := makeGitRepo(t, dir, "user.git", map[string]string{
+		"service.yaml": "name: user\nversion: 22\n",
+		"deploy.yaml":  "apiVersion: v1\nkind: Service\nmetadata:\n  name: user\nspec:\n  clusterIP: None\n",
+	})
+	commit := gitIn(t, repo, "rev-parse", "HEAD")
+
+	work := filepath.Join(dir, "work")
+	os.Mkdir(work, 0777)
+	defer chdir(t, work)()
+	ioutil.WriteFile("up.yaml", []byte("user:\n  repo: file://"+repo+"\n  branch: master\n"), 0644)
+	ioutil.WriteFile("user.yaml", []byte("kind: Service\nmetadata:\n  name: user\nspec:\n  clusterIP: 10.0.0.1\n"), 0644)
+
+	if err := upgrade(newTestContext(t, "upgrade")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+	lock, _ := ioutil.ReadFile("up-lock.yaml")
+	if !strings.Contains(string(lock), commit) || !strings.Contains(string(lock), `version: "22"`) {
+		t.Fatalf("lock should contains commit %s and version 22, got %s", commit, lock)
+	}
+
+	if err := merge(newTestContext(t, "merge")); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	deploy, _ := ioutil.ReadFile("deploy-lock.yaml")
+	if !strings.Contains(string(deploy), "clusterIP: 10.0.0.1") || !strings.Contains(string(deploy), `version: "22"`) {
+		t.Fatalf("wrong deploy-lock.yaml, got %s", deploy)
+	}
+
+	// tampered cache must not be merged
+	ioutil.WriteFile("services/user.yaml", []byte("kind: Service\nmetadata:\n  name: evil\n"), 0644)
+	if err := merge(newTestContext(t, "merge")); err == nil {
+		t.Fatalf("merge should fail on tampered cache")
+	}
+
+	// a lock without integrity hashes is merged only if asked explicitly
+	upgrade(newTestContext(t, "upgrade"))
+	locked, _ := readLock(LockPath)
+	locked["user"].DeploySum = ""
+	writeLock(LockPath, locked)
+	if err := merge(newTestContext(t, "merge")); err == nil {
+		t.Fatalf("merge should fail without sha256 of deploy.yaml")
+	}
+	if err := merge(newTestContext(t, "merge", "--no-verify")); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	upgrade(newTestContext(t, "upgrade"))
+	locked, _ = readLock(LockPath)
+	locked["user"].ServiceSum = "0000"
+	writeLock(LockPath, locked)
+	if err := merge(newTestContext(t, "merge")); err == nil {
+		t.Fatalf("merge should fail on wrong sha256 of service.yaml")
+	}
+
+	// merge reads only local files, the source repo is not needed
+	upgrade(newTestContext(t, "upgrade"))
+	os.Rename(repo, repo+".gone")
+	defer os.Rename(repo+".gone", repo)
+	if err := merge(newTestContext(t, "merge")); err != nil {
+		t.Fatalf("merge should not need the source repo, got %v", err)
+	}
+	ioutil.WriteFile("services/user.service.yaml", []byte("name: user\nversion: 23\n"), 0644)
+	if err := merge(newTestContext(t, "merge")); err == nil {
+		t.Fatalf("merge should fail on tampered service.yaml")
+	}
+}
+
+func TestUpgradeKeepGoing(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	repo := makeGitRepo(t, dir, "user.git", map[string]string{
+		"service.yaml": "name: user\nversion: 3\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: user\n",
+	})
+	defer chdir(t, dir)()
+	ioutil.WriteFile("up.yaml", []byte("user:\n  repo: "+repo+"\naccount:\n  repo: "+dir+"/missing.git\n  branch: master\n"), 0644)
+
+	if err := upgrade(newTestContext(t, "upgrade")); err == nil {
+		t.Fatalf("upgrade should fail")
+	}
+	if _, err := os.Stat("up-lock.yaml"); !os.IsNotExist(err) {
+		t.Fatalf("up-lock.yaml should not be written")
+	}
+
+	if err := upgrade(newTestContext(t, "upgrade", "--keep-going")); err == nil {
+		t.Fatalf("upgrade should still fail")
+	}
+	lock, _ := ioutil.ReadFile("up-lock.yaml")
+	if !strings.Contains(string(lock), "user:") || strings.Contains(string(lock), "account:") {
+		t.Fatalf("lock should contain only user, got %s", lock)
+	}
+}
+
+func TestUpgradeOnlySelectedServices(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	user := makeGitRepo(t, dir, "user", map[string]string{"service.yaml": "name: user\nversion: 1\n", "deploy.yaml": ""})
+	account := makeGitRepo(t, dir, "account", map[string]string{"service.yaml": "name: account\nversion: 1\n", "deploy.yaml": ""})
+	defer chdir(t, dir)()
+	ioutil.WriteFile("up.yaml", []byte("user:\n  repo: "+user+"\n  branch: master\naccount:\n  repo: "+account+"\n  branch: master\n"), 0644)
+	if err := upgrade(newTestContext(t, "upgrade")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+
+	oldaccount := gitIn(t, account, "rev-parse", "HEAD")
+	commitFiles(t, user, map[string]string{"service.yaml": "name: user\nversion: 2\n"})
+	commitFiles(t, account, map[string]string{"service.yaml": "name: account\nversion: 2\n"})
+	if err := upgrade(newTestContext(t, "upgrade", "user")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+
+	lock, err := readLock(LockPath)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if lock["user"].Version != "2" || lock["user"].Commit != gitIn(t, user, "rev-parse", "HEAD") {
+		t.Fatalf("user should be upgraded, got %v", lock["user"])
+	}
+	if lock["account"].Version != "1" || lock["account"].Commit != oldaccount {
+		t.Fatalf("account should stay at locked commit, got %v", lock["account"])
+	}
+
+	if err := upgrade(newTestContext(t, "upgrade", "--except", "user")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+	lock, _ = readLock(LockPath)
+	if lock["account"].Version != "2" {
+		t.Fatalf("account should be upgraded, got %v", lock["account"])
+	}
+
+	if err := upgrade(newTestContext(t, "upgrade", "billing")); err == nil {
+		t.Fatalf("should fail for unknown service")
+	}
+}
+
+func TestMergeServiceNamedDifferently(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	repo := makeGitRepo(t, dir, "user", map[string]string{
+		"service.yaml": "name: user\nversion: 5\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: '{name}'\nspec:\n  clusterIP: None\n",
+	})
+	defer chdir(t, dir)()
+	ioutil.WriteFile("up.yaml", []byte("users:\n  repo: "+repo+"\n  branch: master\n"), 0644)
+	ioutil.WriteFile("users.yaml", []byte("kind: Service\nmetadata:\n  name: user\nspec:\n  clusterIP: 10.0.0.2\n"), 0644)
+	if err := upgrade(newTestContext(t, "upgrade")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+
+	lock, _ := readLock(LockPath)
+	if lock["users"].Name != "user" || lock["users"].Cache != "services/user.yaml" {
+		t.Fatalf("lock should record name and cache path, got %v", lock["users"])
+	}
+	if err := merge(newTestContext(t, "merge")); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	deploy, _ := ioutil.ReadFile("deploy-lock.yaml")
+	if !strings.Contains(string(deploy), "clusterIP: 10.0.0.2") || !strings.Contains(string(deploy), "service: user") {
+		t.Fatalf("wrong deploy-lock.yaml, got %s", deploy)
+	}
+
+	// two keys of the same service would share the cache
+	ioutil.WriteFile("up.yaml", []byte("users:\n  repo: "+repo+"\n  branch: master\nuser:\n  repo: "+repo+"\n  branch: master\n"), 0644)
+	if err := upgrade(newTestContext(t, "upgrade")); err == nil {
+		t.Fatalf("upgrade should fail on name conflict")
+	}
+
+	lock["users"].Cache = ""
+	writeLock(LockPath, lock)
+	if err := merge(newTestContext(t, "merge")); err == nil {
+		t.Fatalf("merge should fail without cache path")
+	}
+}
+
+func TestUpgradeNameConflictDoesNotWriteCache(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	a := makeGitRepo(t, dir, "a", map[string]string{
+		"service.yaml": "name: user\nversion: 1\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: a\n",
+	})
+	b := makeGitRepo(t, dir, "b", map[string]string{
+		"service.yaml": "name: user\nversion: 1\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: b\n",
+	})
+	evil := makeGitRepo(t, dir, "evil", map[string]string{
+		"service.yaml": "name: ../evil\nversion: 1\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: evil\n",
+	})
+	work := filepath.Join(dir, "work")
+	os.Mkdir(work, 0777)
+	defer chdir(t, work)()
+	ioutil.WriteFile("up.yaml", []byte("a:\n  repo: "+a+"\nb:\n  repo: "+b+"\nevil:\n  repo: "+evil+"\n"), 0644)
+
+	if err := upgrade(newTestContext(t, "upgrade", "--keep-going")); err == nil {
+		t.Fatalf("upgrade should fail on name conflict and invalid name")
+	}
+	if _, err := os.Stat("services/user.yaml"); err == nil {
+		t.Fatalf("conflicting services should not be cached")
+	}
+	if _, err := os.Stat("evil.yaml"); err == nil {
+		t.Fatalf("service should not be cached outside of the cache")
+	}
+
+	if _, err := loadDeploy("a", &Version{Cache: "../up.yaml"}); err == nil {
+		t.Fatalf("cache path outside of the cache should fail")
+	}
+}
+
+func TestMergeEnvOverlays(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	repo := makeGitRepo(t, dir, "user.git", map[string]string{
+		"service.yaml": "name: user\nversion: 3\n",
+		"deploy.yaml":  "kind: Deployment\nmetadata:\n  name: user\nspec:\n  replicas: 1\n  paused: false\n",
+	})
+
+	work := filepath.Join(dir, "work")
+	os.Mkdir(work, 0777)
+	defer chdir(t, work)()
+	ioutil.WriteFile("up.yaml", []byte("user:\n  repo: file://"+repo+"\n  branch: master\n"), 0644)
+	ioutil.WriteFile("user.yaml", []byte("kind: Deployment\nmetadata:\n  name: user\nspec:\n  replicas: 2\n  minReadySeconds: 5\n"), 0644)
+	ioutil.WriteFile("user.prod.yaml", []byte("kind: Deployment\nmetadata:\n  name: user\nspec:\n  replicas: 5\n"), 0644)
+	ioutil.WriteFile("common.prod.yaml", []byte("kind: Deployment\nmetadata:\n  name: user\nspec:\n  paused: true\n---\nkind: Deployment\nmetadata:\n  name: account\nspec:\n  paused: true\n"), 0644)
+
+	if err := upgrade(newTestContext(t, "upgrade")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+	if err := merge(newTestContext(t, "merge", "--env", "prod")); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	deploy, _ := ioutil.ReadFile("deploy-lock.prod.yaml")
+	for _, want := range []string{"replicas: 5", "minReadySeconds: 5", "paused: true"} {
+		if !strings.Contains(string(deploy), want) {
+			t.Fatalf("deploy-lock.prod.yaml should contains %q, got %s", want, deploy)
+		}
+	}
+	if _, err := os.Stat("deploy-lock.yaml"); err == nil {
+		t.Fatalf("deploy-lock.yaml should not be written")
+	}
+
+	if err := merge(newTestContext(t, "merge", "--env", "qa")); err == nil {
+		t.Fatalf("merge should fail on unknown env")
+	}
+}
+
+func TestLocalGitRejectsOptions(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	repo := makeGitRepo(t, dir, "user", map[string]string{"service.yaml": "name: user\n"})
+	commit := gitIn(t, repo, "rev-parse", "HEAD")
+	out := filepath.Join(dir, "out")
+
+	l := &LocalGit{}
+	if _, err := l.GetLatestCommit(repo, "--output="+out); err == nil {
+		t.Fatalf("branch starting with - should be rejected")
+	}
+	if _, err := l.ListCommits(repo, "--output="+out, commit); err == nil {
+		t.Fatalf("commit starting with - should be rejected")
+	}
+	if _, err := l.GetFile(repo, "--output="+out, "service.yaml"); err == nil {
+		t.Fatalf("commit starting with - should be rejected")
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Fatalf("git should not write %s", out)
+	}
+	if latest, err := l.GetLatestCommit(repo, "master"); err != nil || latest != commit {
+		t.Fatalf("should resolve branch master to %s, got %s %v", commit, latest, err)
+	}
+}
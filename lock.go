@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const UpPath = "up.yaml"
+const LockPath = "up-lock.yaml"
+
+// readVersions reads services of up.yaml or up-lock.yaml
+func readVersions(path string) (map[string]*Version, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make(map[string]*Version) // version in map format
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("wrong yaml in %s: %v", path, err)
+	}
+	for sname, sver := range v {
+		if sver == nil {
+			return nil, fmt.Errorf("service %s in %s is empty", sname, path)
+		}
+	}
+	return v, nil
+}
+
+// readLock reads locked services, a missing lock file has no service
+func readLock(path string) (map[string]*Version, error) {
+	v, err := readVersions(path)
+	if os.IsNotExist(err) {
+		return make(map[string]*Version), nil
+	}
+	return v, err
+}
+
+// marshalLock returns the canonical form of a lock: services sorted by name,
+// fields in fixed order and empty fields omitted
+func marshalLock(v map[string]*Version) ([]byte, error) {
+	if len(v) == 0 {
+		return []byte{}, nil
+	}
+	// maps are marshaled with keys sorted
+	return marshalYAML(v)
+}
+
+// writeLock writes services to the lock file in canonical form, under a header
+// telling which up version generated it and when. The file is left untouched
+// when services are not changed, so the header doesn't make noise in git
+func writeLock(path string, v map[string]*Version) error {
+	data, err := marshalLock(v)
+	if err != nil {
+		return err
+	}
+
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(stripLockHeader(old), data) {
+		return nil
+	}
+	header := fmt.Sprintf("# generated by up %s at %s, do not edit\n", UpVersion, time.Now().UTC().Format(time.RFC3339))
+	return ioutil.WriteFile(path, append([]byte(header), data...), 0644)
+}
+
+// stripLockHeader removes leading comment lines of a lock file
+func stripLockHeader(data []byte) []byte {
+	for bytes.HasPrefix(data, []byte("#")) {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return []byte{}
+		}
+		data = data[i+1:]
+	}
+	return data
+}
+
+// selectServices returns services in up.yaml to be upgraded. Without any
+// names, all services are selected
+func selectServices(v map[string]*Version, names, only, except []string) (map[string]bool, error) {
+	selected := make(map[string]bool)
+	only = append(splitNames(names), splitNames(only)...)
+	for _, name := range only {
+		if v[name] == nil {
+			return nil, fmt.Errorf("service %s not found in %s", name, UpPath)
+		}
+		selected[name] = true
+	}
+	if len(only) == 0 {
+		for sname := range v {
+			selected[sname] = true
+		}
+	}
+
+	for _, name := range splitNames(except) {
+		if v[name] == nil {
+			return nil, fmt.Errorf("service %s not found in %s", name, UpPath)
+		}
+		delete(selected, name)
+	}
+	return selected, nil
+}
+
+// splitNames splits comma separated service names
+func splitNames(names []string) []string {
+	out := make([]string, 0)
+	for _, name := range names {
+		for _, n := range strings.Split(name, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteLock(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+
+	v := map[string]*Version{
+		"user":    {Repo: "subiz/user", Branch: "master", Commit: "f3ae417", Version: "22"},
+		"account": {Repo: "subiz/account", Commit: "250cfc370", Version: "1"},
+	}
+	path := filepath.Join(dir, "up-lock.yaml")
+	if err := writeLock(path, v); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), "# generated by up "+UpVersion+" at ") {
+		t.Fatalf("should have header, got %s", data)
+	}
+	expect := `account:
+  repo: subiz/account
+  commit: 250cfc370
+  version: "1"
+user:
+  repo: subiz/user
+  branch: master
+  commit: f3ae417
+  version: "22"
+`
+	if body := string(stripLockHeader(data)); body != expect {
+		t.Fatalf("expect\n%s\ngot\n%s", expect, body)
+	}
+
+	// rewriting the same services keeps the file untouched
+	ioutil.WriteFile(path, append([]byte("# old header\n"), stripLockHeader(data)...), 0644)
+	if err := writeLock(path, v); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), "# old header\n") {
+		t.Fatalf("unchanged lock should not be rewritten, got %s", data)
+	}
+
+	lock, err := readLock(path)
+	if err != nil || lock["user"].Commit != "f3ae417" || lock["account"].Branch != "" {
+		t.Fatalf("wrong lock, got %v %v", lock, err)
+	}
+}
@@ -6,14 +6,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	toml "github.com/BurntSushi/toml"
@@ -22,32 +24,23 @@ import (
 	"github.com/tidwall/gjson"
 	"github.com/urfave/cli"
 	"github.com/valyala/fasthttp"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+const UpVersion = "0.3.6"
 const ServiceCachePath = "./services"
 const ConfigPath = ".up"
 
-type ByName []Service
-
-func (n ByName) Len() int           { return len(n) }
-func (n ByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
-func (n ByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
-
 type Config struct {
-	Kind, Name, Content string
+	ID      resourceID
+	Content string
 }
 
-type ByKindAndName []Config
+type ByResource []Config
 
-func (n ByKindAndName) Len() int      { return len(n) }
-func (n ByKindAndName) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
-func (n ByKindAndName) Less(i, j int) bool {
-	if n[i].Name == n[j].Name {
-		return n[i].Kind < n[j].Kind
-	}
-	return n[i].Name < n[j].Name
-}
+func (n ByResource) Len() int           { return len(n) }
+func (n ByResource) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n ByResource) Less(i, j int) bool { return n[i].ID.less(n[j].ID) }
 
 type Service struct {
 	Name    string
@@ -57,11 +50,23 @@ type Service struct {
 	commit  string
 }
 
+// Version is a service in up.yaml or up-lock.yaml, fields are written to the
+// lock file in this order
 type Version struct {
-	Commit  string
-	Repo    string
-	Branch  string
-	Version string
+	Repo    string `yaml:"repo"`
+	Host    string `yaml:"host,omitempty"`
+	Branch  string `yaml:"branch,omitempty"`
+	Commit  string `yaml:"commit,omitempty"`
+	Version string `yaml:"version,omitempty"`
+
+	// name of the service in service.yaml, which may differ from its key in
+	// up.yaml, and path of its cached deploy.yaml
+	Name  string `yaml:"name,omitempty"`
+	Cache string `yaml:"cache,omitempty"`
+
+	// sha256 of deploy.yaml and service.yaml fetched at commit
+	DeploySum  string `yaml:"deploy_sha256,omitempty"`
+	ServiceSum string `yaml:"service_sha256,omitempty"`
 }
 
 type UpConfig struct {
@@ -70,6 +75,19 @@ type UpConfig struct {
 	Stag   string `toml:"stag"`
 	Prod   string `toml:"prod"`
 	Dev    string `toml:"dev"`
+
+	// default namespace of each environment
+	StagNamespace string `toml:"stag_namespace"`
+	ProdNamespace string `toml:"prod_namespace"`
+	DevNamespace  string `toml:"dev_namespace"`
+
+	GithubToken string `toml:"github_token"`
+	GithubURL   string `toml:"github_url"`
+	GitlabToken string `toml:"gitlab_token"`
+	GitlabURL   string `toml:"gitlab_url"`
+	GiteaToken  string `toml:"gitea_token"`
+	GiteaURL    string `toml:"gitea_url"`
+	CacheSize   int64  `toml:"cache_size"` // in megabytes
 }
 
 var gconfig UpConfig
@@ -94,16 +112,49 @@ func config(c *cli.Context) error {
 	case "bitbucket_pass":
 		gconfig.Bbpass = value
 		tryLoginBb()
+	case "github_token":
+		gconfig.GithubToken = value
+		tryLoginGithub()
+	case "github_url":
+		gconfig.GithubURL = value
+	case "gitlab_token":
+		gconfig.GitlabToken = value
+	case "gitlab_url":
+		gconfig.GitlabURL = value
+	case "gitea_token":
+		gconfig.GiteaToken = value
+	case "gitea_url":
+		gconfig.GiteaURL = value
+	case "cache_size":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			fmt.Println("cache_size must be a number of megabytes")
+			return nil
+		}
+		gconfig.CacheSize = size
 	case "stag":
 		gconfig.Stag = value
 	case "prod":
 		gconfig.Prod = value
 	case "dev":
 		gconfig.Dev = value
+	case "stag_namespace":
+		gconfig.StagNamespace = value
+	case "prod_namespace":
+		gconfig.ProdNamespace = value
+	case "dev_namespace":
+		gconfig.DevNamespace = value
 	case "clear":
 		gconfig = UpConfig{}
 	case "get":
-		fmt.Printf("stag: %s\nprod: %s\ndev %s\n", gconfig.Stag, gconfig.Prod, gconfig.Dev)
+		namespace := func(env string) string {
+			if ns := configNamespace(env); ns != "" {
+				return ns
+			}
+			return "of the context"
+		}
+		fmt.Printf("stag: %s (namespace %s)\nprod: %s (namespace %s)\ndev %s (namespace %s)\n",
+			gconfig.Stag, namespace("stag"), gconfig.Prod, namespace("prod"), gconfig.Dev, namespace("dev"))
 		return nil
 	default:
 		fmt.Printf("unknown config")
@@ -132,7 +183,11 @@ func tryLoginBb() {
 	}
 
 	url := "https://api.bitbucket.org/1.0/user"
-	code, body := getHTTP(url, gconfig.Bbuser, gconfig.Bbpass, nil)
+	code, body, err := newHTTPClient(DefaultHTTPRetries).get(url, gconfig.Bbuser, gconfig.Bbpass, nil)
+	if err != nil {
+		fmt.Printf("ERR: cant login: %v\n", err)
+		return
+	}
 	if code != 200 {
 		fmt.Printf("ERR: cant login, got code %d\n", code)
 		return
@@ -143,8 +198,12 @@ func tryLoginBb() {
 
 func main() {
 	loadUpConfig()
+	newApp().Run(os.Args)
+}
+
+func newApp() *cli.App {
 	app := cli.NewApp()
-	app.Version = "0.3.6"
+	app.Version = UpVersion
 	cli.VersionFlag = cli.BoolFlag{
 		Name:  "version, V",
 		Usage: "print the version",
@@ -159,20 +218,148 @@ func main() {
 		},
 		{
 			Name:   "config",
-			Usage:  "set config: bitbucket_user, bitbucket_pass, stag, prod, dev",
+			Usage:  "set config: bitbucket_user, bitbucket_pass, github_token, github_url, gitlab_token, gitlab_url, gitea_token, gitea_url, cache_size, stag, prod, dev, stag_namespace, prod_namespace, dev_namespace",
 			Action: config,
 		},
 		{
 			Name:    "upgrade",
 			Aliases: []string{"u"},
-			Usage:   "fetch for new version of all service into up-lock.yaml",
+			Usage:   "fetch for new version of services into up-lock.yaml, eg: up upgrade user account",
 			Action:  upgrade,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "only",
+					Usage: "upgrade only these services, others stay at their locked commit",
+				},
+				cli.StringSliceFlag{
+					Name:  "except",
+					Usage: "upgrade all services except these, which stay at their locked commit",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going, k",
+					Usage: "write up-lock.yaml for succeeded services even if some services failed",
+				},
+				cli.IntFlag{
+					Name:  "concurrency, c",
+					Value: 8,
+					Usage: "number of services to upgrade in parallel",
+				},
+				retriesFlag,
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "manage files fetched by upgrade, cached in ~/.up/cache",
+			Subcommands: []cli.Command{
+				{
+					Name:   "prune",
+					Usage:  "remove least recently used files until the cache fits cache_size",
+					Action: cachePrune,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "remove all cached files",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "show changes of services between two lock files, or between up-lock.yaml and latest commits",
+			ArgsUsage: "[old-lock] [new-lock]",
+			Action:    diff,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "no-log",
+					Usage: "do not list commits between old and new commit",
+				},
+				retriesFlag,
+			},
 		},
 		{
 			Name:    "merge",
 			Aliases: []string{"m"},
 			Usage:   "merge all deployment file and its modification",
 			Action:  merge,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "keep-going, k",
+					Usage: "write deploy-lock.yaml for succeeded services even if some services failed",
+				},
+				cli.StringFlag{
+					Name:  "env, e",
+					Usage: "apply <service>.<env>.yaml and common.<env>.yaml overlays, then write deploy-lock.<env>.yaml",
+				},
+				cli.BoolFlag{
+					Name:  "no-verify",
+					Usage: "merge without checking deploy.yaml and service.yaml against their sha256 in up-lock.yaml",
+				},
+			},
+		},
+		{
+			Name:   "apply",
+			Usage:  "apply configs of deploy-lock.yaml whose version changed to kubernetes",
+			Action: apply,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "env, e",
+					Usage: "apply deploy-lock.<env>.yaml to the kubernetes context of env, set by up config <env> <CONTEXT>",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: DefaultRolloutTimeout,
+					Usage: "wait for rollouts of applied deployments, statefulsets and daemonsets, 0 to not wait",
+				},
+				cli.BoolFlag{
+					Name:  "rollback",
+					Usage: "re-apply the previously applied lock when configs fail to apply or a rollout fails",
+				},
+				forceConflictsFlag,
+			},
+		},
+		{
+			Name:   "history",
+			Usage:  "list applied locks and their service versions, kept as configmaps in the cluster",
+			Action: history,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "env, e",
+					Usage: "list locks applied to env",
+				},
+			},
+		},
+		{
+			Name:   "rollback",
+			Usage:  "re-apply the previously applied lock",
+			Action: rollback,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "env, e",
+					Usage: "roll back the kubernetes context of env",
+				},
+				cli.IntFlag{
+					Name:  "to",
+					Usage: "re-apply history entry N instead of the previous one, see up history",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: DefaultRolloutTimeout,
+					Usage: "wait for rollouts of re-applied workloads, 0 to not wait",
+				},
+				forceConflictsFlag,
+			},
+		},
+		{
+			Name:   "drift",
+			Usage:  "show differences between deploy-lock.yaml and the kubernetes cluster",
+			Action: drift,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "env, e",
+					Usage: "compare deploy-lock.<env>.yaml with the kubernetes context of env",
+				},
+			},
 		},
 		{
 			Name:    "add",
@@ -182,6 +369,12 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:   "verify",
+			Usage:  "check up.yaml, up-lock.yaml, cached deployments and modifications are consistent",
+			Action: verify,
+			Flags:  []cli.Flag{retriesFlag},
+		},
 		{
 			Name:   "compile-dev",
 			Usage:  "complie deploy-dev.yaml",
@@ -215,59 +408,191 @@ func main() {
 
 	sort.Sort(cli.FlagsByName(app.Flags))
 	sort.Sort(cli.CommandsByName(app.Commands))
-	app.Run(os.Args)
+	return app
+}
+
+// serviceResult is the outcome of upgrading or merging a service in up.yaml
+type serviceResult struct {
+	Key     string // key of the service in up.yaml
+	Version *Version
+	Deploy  []byte // fetched deploy.yaml of an upgraded service
+	Service []byte // fetched service.yaml of an upgraded service
+	Err     error
 }
 
-func printServices(services []Service) {
-	sort.Sort(ByName(services))
+type ByKey []serviceResult
+
+func (n ByKey) Len() int           { return len(n) }
+func (n ByKey) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n ByKey) Less(i, j int) bool { return n[i].Key < n[j].Key }
+
+// printSummary prints a table of services and their status, returns number of
+// failed services
+func printSummary(results []serviceResult) int {
+	sort.Sort(ByKey(results))
+	failed := 0
 	fmt.Println("--")
-	for _, s := range services {
-		fmt.Printf("%s %s #%d\n", s.commit[:7], s.Name, s.Version)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tCOMMIT\tVERSION\tSTATUS")
+	for _, r := range results {
+		commit, version := shortCommit(r.Version.Commit), "#"+r.Version.Version
+		if commit == "" {
+			commit = "-"
+		}
+		if r.Version.Version == "" {
+			version = "-"
+		}
+		status := color.GreenString("ok")
+		if r.Err != nil {
+			failed++
+			status = color.RedString("ERR: %v", r.Err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Key, commit, version, status)
+	}
+	w.Flush()
+	fmt.Printf("total %d services, %d failed.\n", len(results), failed)
+	return failed
+}
+
+// shortCommit returns the 7 characters abbreviation of commit
+func shortCommit(commit string) string {
+	if len(commit) < 7 {
+		return commit
 	}
-	fmt.Printf("total %d services.\n", len(services))
+	return commit[:7]
 }
 
-func sortDeployment(dep []byte) []byte {
-	depsplit := RegSplit(string(dep), "(?m:^[-]{3,})")
+func sortDeployment(dep []byte) ([]byte, error) {
+	docs, err := parseDocs(dep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
 	configs := make([]Config, 0)
-	for _, config := range depsplit {
-		config = strings.TrimSpace(config)
-		if config == "" {
-			continue
+	for _, doc := range docs {
+		content, err := marshalYAML(doc)
+		if err != nil {
+			return nil, err
 		}
-		_, name, kind := parseConfig(config)
 		configs = append(configs, Config{
-			Name:    name,
-			Kind:    kind,
-			Content: config,
+			ID:      getResourceID(doc),
+			Content: string(content),
 		})
 	}
-	sort.Sort(ByKindAndName(configs))
+	sort.Sort(ByResource(configs))
 
-	depsplit = make([]string, 0)
+	depsplit := make([]string, 0)
 	for _, config := range configs {
 		depsplit = append(depsplit, config.Content)
 	}
-	return []byte(strings.Join(depsplit, "\n---\n"))
+	return []byte(strings.Join(depsplit, "---\n")), nil
 }
 
-func saveDeploy(name string, deploy []byte) {
-	_ = os.Mkdir(ServiceCachePath, 0777)
-	if err := ioutil.WriteFile(ServiceCachePath+"/"+name+".yaml", deploy, 0644); err != nil {
-		panic(err)
+// checkServiceName checks name of a service from its service.yaml, which names
+// its files in the service cache
+func checkServiceName(name string) error {
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) ||
+		strings.HasSuffix(name, ".service") {
+		return fmt.Errorf("invalid name %q in service.yaml", name)
+	}
+	return nil
+}
+
+// servicePath returns path of the cached service.yaml of a service, next to
+// its cached deploy.yaml
+func servicePath(cache string) string {
+	return strings.TrimSuffix(cache, ".yaml") + ".service.yaml"
+}
+
+// saveDeploy saves deploy.yaml and service.yaml of service name into the
+// service cache, returns path of the cached deploy.yaml
+func saveDeploy(name string, deploy, service []byte) (string, error) {
+	if err := checkServiceName(name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(ServiceCachePath, name+".yaml")
+	if err := writeFileAtomic(servicePath(path), service); err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, deploy)
+}
+
+// loadDeploy reads the cached deploy.yaml of service sname at path recorded
+// in up-lock.yaml
+func loadDeploy(sname string, sver *Version) ([]byte, error) {
+	if sver.Cache == "" {
+		return nil, fmt.Errorf("up-lock.yaml has no cache path for service %s, it was written by an older up, try up upgrade %s", sname, sname)
+	}
+	if filepath.IsAbs(sver.Cache) || filepath.Dir(filepath.Clean(sver.Cache)) != filepath.Clean(ServiceCachePath) {
+		return nil, fmt.Errorf("cache path %s of service %s in up-lock.yaml is not in %s", sver.Cache, sname, ServiceCachePath)
 	}
+	deploy, err := ioutil.ReadFile(sver.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("no cached deployment for service %s (%s), try up upgrade %s: %v", sname, sver.Name, sname, err)
+	}
+	return deploy, nil
 }
 
-func loadDeploy(name string) []byte {
-	deploy, err := ioutil.ReadFile(ServiceCachePath + "/" + name + ".yaml")
+// loadService reads the cached service.yaml of service sname, next to its
+// cached deploy.yaml read by loadDeploy
+func loadService(sname string, sver *Version) ([]byte, error) {
+	body, err := ioutil.ReadFile(servicePath(sver.Cache))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("no cached service.yaml for service %s (%s), try up upgrade %s: %v", sname, sver.Name, sname, err)
+	}
+	return body, nil
+}
+
+// verifyDeploy checks the cached deployment of a service against its integrity
+// hash in up-lock.yaml, so a tampered cache is never merged
+func verifyDeploy(sname string, sver *Version, deploy []byte) error {
+	if sver.DeploySum == "" {
+		return fmt.Errorf("up-lock.yaml has no sha256 of deploy.yaml for service %s, try up upgrade %s", sname, sname)
+	}
+	if sum := sha256sum(deploy); sum != sver.DeploySum {
+		return fmt.Errorf("cached deployment %s has sha256 %s, expect %s from up-lock.yaml, "+
+			"it was modified after upgrade, try up upgrade %s", sver.Cache, sum, sver.DeploySum, sname)
+	}
+	return nil
+}
+
+// checkNameConflicts fails services whose service.yaml name is also used by
+// another service in up.yaml, they would overwrite each other in the cache
+func checkNameConflicts(results []serviceResult, kept map[string]*Version) {
+	keys := make(map[string][]string) // service name => keys in up.yaml
+	for sname, sver := range kept {
+		keys[sver.Name] = append(keys[sver.Name], sname)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			keys[r.Version.Name] = append(keys[r.Version.Name], r.Key)
+		}
+	}
+
+	for i, r := range results {
+		if r.Err != nil || len(keys[r.Version.Name]) < 2 {
+			continue
+		}
+		others := make([]string, 0)
+		for _, key := range keys[r.Version.Name] {
+			if key != r.Key {
+				others = append(others, key)
+			}
+		}
+		sort.Strings(others)
+		results[i].Err = fmt.Errorf("name %s in service.yaml is also used by %s", r.Version.Name, strings.Join(others, ", "))
 	}
-	return deploy
 }
 
-func checkLoginBb() {
-	if gconfig.Bbuser == "" || gconfig.Bbpass == "" {
+// checkLoginBb asks to login to bitbucket if a selected service is fetched
+// from there
+func checkLoginBb(v map[string]*Version, selected map[string]bool) {
+	usesBb := false
+	for sname := range selected {
+		if sver := v[sname]; sver != nil && isBitbucket(sver.Host, sver.Repo) {
+			usesBb = true
+		}
+	}
+	if usesBb && (gconfig.Bbuser == "" || gconfig.Bbpass == "") {
 		fmt.Println("look like you haven't login to bitbucket yet")
 		fmt.Println("try")
 		fmt.Println("up config set bitbucket_user <YOURBITBUCKETUSER>")
@@ -275,80 +600,260 @@ func checkLoginBb() {
 		fmt.Println("to login to bitbucket")
 	}
 }
+
+// resolveService resolves the commit of a service if it tracks a branch then
+// reads its service.yaml, sver is updated with the commit and version. When
+// the host can not be reached, the service stays at its commit in locked if
+// locked tracks the same branch, so its files come from the fetch cache
+func resolveService(sver, locked *Version, h *httpClient) (SourceProvider, Service, []byte, error) {
+	provider, err := getProvider(sver.Host, sver.Repo, h)
+	if err != nil {
+		return nil, Service{}, nil, err
+	}
+	if sver.Commit == "" {
+		// get commit
+		commit, err := provider.GetLatestCommit(sver.Repo, sver.Branch)
+		if _, offline := err.(*unreachableError); offline && sameBranch(sver, locked) {
+			fmt.Printf("WARN: %v, keep repo %s at locked commit %s\n", err, sver.Repo, shortCommit(locked.Commit))
+			commit, err = locked.Commit, nil
+		}
+		if err != nil {
+			return nil, Service{}, nil, err
+		}
+		if commit == "" {
+			return nil, Service{}, nil, fmt.Errorf("no commit found for repo %s branch %s", sver.Repo, sver.Branch)
+		}
+		sver.Commit = commit
+	}
+	fmt.Printf("INFO: fetching repo %s (%s)\n", sver.Repo, shortCommit(sver.Commit))
+	body, err := provider.GetFile(sver.Repo, sver.Commit, "service.yaml")
+	if err != nil {
+		return nil, Service{}, nil, err
+	}
+	service, err := unmarshalService(sver.Repo, body)
+	if err != nil {
+		return nil, Service{}, nil, err
+	}
+	sver.Version = strconv.Itoa(service.Version)
+	sver.ServiceSum = sha256sum(body)
+	return provider, service, body, nil
+}
+
+// sameBranch tells whether locked is a commit of the branch tracked by sver
+func sameBranch(sver, locked *Version) bool {
+	return locked != nil && locked.Commit != "" && locked.Repo == sver.Repo &&
+		locked.Host == sver.Host && locked.Branch == sver.Branch
+}
+
+// upgradeService resolves a service then fetches its deploy.yaml, which is
+// saved into the service cache with its service.yaml by the caller
+func upgradeService(sver, locked *Version, h *httpClient) (deploy, body []byte, err error) {
+	provider, service, body, err := resolveService(sver, locked, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkServiceName(service.Name); err != nil {
+		return nil, nil, err
+	}
+	deploy, err = getDeployYaml(provider, sver.Repo, sver.Commit)
+	if err != nil {
+		return nil, nil, err
+	}
+	sver.Name = service.Name
+	sver.DeploySum = sha256sum(deploy)
+	return deploy, body, nil
+}
+
 func upgrade(c *cli.Context) error {
-	checkLoginBb()
-	version, err := ioutil.ReadFile("up.yaml")
-	if err != nil || string(version) == "" {
+	v, err := readVersions(UpPath)
+	if err != nil {
 		fmt.Println(color.RedString(("unable to read ./up.yaml")))
 		return cli.NewExitError(err, -43)
 	}
 
-	v := make(map[string]*Version) // version in map format
-	if err := yaml.Unmarshal(version, &v); err != nil {
-		fmt.Println(color.RedString(("wrong yaml")))
+	selected, err := selectServices(v, c.Args(), c.StringSlice("only"), c.StringSlice("except"))
+	if err != nil {
+		return cli.NewExitError(err, -46)
+	}
+	checkLoginBb(v, selected)
+
+	// services which are not selected stay at their locked commit
+	lock, err := readLock(LockPath)
+	if err != nil {
+		fmt.Println(color.RedString(("unable to read ./up-lock.yaml")))
 		return cli.NewExitError(err, -42)
 	}
+	outv := make(map[string]*Version)
+	for sname := range v {
+		if selected[sname] {
+			continue
+		}
+		if lock[sname] == nil {
+			fmt.Printf("WARN: service %s is not locked yet, skipped\n", sname)
+			continue
+		}
+		fmt.Printf("INFO: keep service %s at %s\n", sname, shortCommit(lock[sname].Commit))
+		outv[sname] = lock[sname]
+	}
 
-	outServices := make([]Service, 0)
+	h := newHTTPClient(c.Int("retries"))
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
+	// upgrade services using a pool of concurrency workers, so we don't
+	// hammer the source hosts
+	snames := make(chan string)
+	results := make([]serviceResult, 0)
 	mutex := &sync.Mutex{}
 	var wg sync.WaitGroup
-	for sname, sver := range v {
+	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
-		go func(sname string, sver *Version) {
+		go func() {
 			defer wg.Done()
-			if sver.Commit == "" {
-				// get commit
-				commit := getLatestCommit(sver.Repo, sver.Branch, gconfig.Bbuser, gconfig.Bbpass)
-				if commit == "" {
-					panic("no commit found for repo " + sver.Repo + " branch " + sver.Branch)
-				}
-				sver.Commit = commit
+			for sname := range snames {
+				deploy, body, err := upgradeService(v[sname], lock[sname], h)
+				mutex.Lock()
+				results = append(results, serviceResult{Key: sname, Version: v[sname], Deploy: deploy, Service: body, Err: err})
+				mutex.Unlock()
 			}
-			fmt.Printf("INFO: fetching repo %s (%s)\n", sver.Repo, sver.Commit[:7])
-			service := getService(sver.Repo, sver.Commit, gconfig.Bbuser, gconfig.Bbpass)
-			version := strconv.Itoa(service.Version)
-			deploy := getDeployYaml(sver.Repo, sver.Commit, gconfig.Bbuser, gconfig.Bbpass)
+		}()
+	}
+	for sname := range selected {
+		snames <- sname
+	}
+	close(snames)
+	wg.Wait()
 
-			fmt.Printf("INFO: save deployment for service %s at %s/%s.yaml\n", service.Name, ServiceCachePath, service.Name)
-			saveDeploy(service.Name, deploy)
+	if _, _, err := pruneCache(getCacheDir(), getCacheSize()); err != nil {
+		fmt.Printf("WARN: unable to prune cache: %v\n", err)
+	}
 
-			mutex.Lock()
-			service.commit = sver.Commit
-			service.build = sver.Commit + "-" + version
-			outServices = append(outServices, service)
-			sver.Version = version
-			mutex.Unlock()
-		}(sname, sver)
+	// deployments are saved only after conflicting names are failed, and
+	// only if up-lock.yaml is written, so the cache always matches the lock
+	checkNameConflicts(results, outv)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
 	}
-	wg.Wait()
-	version, err = yaml.Marshal(&v)
-	if err != nil {
-		panic(err)
+	if failed == 0 || c.Bool("keep-going") {
+		for i, r := range results {
+			if r.Err != nil {
+				continue
+			}
+			path, err := saveDeploy(r.Version.Name, r.Deploy, r.Service)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			fmt.Printf("INFO: saved deployment for service %s at %s\n", r.Version.Name, path)
+			r.Version.Cache = path
+		}
+	}
+	failed = printSummary(results)
+	if failed > 0 && !c.Bool("keep-going") {
+		fmt.Println(color.RedString("up-lock.yaml is not written"))
+		return cli.NewExitError(fmt.Sprintf("%d of %d services failed to upgrade", failed, len(results)), -44)
 	}
 
-	printServices(outServices)
+	for _, r := range results {
+		if r.Err == nil {
+			outv[r.Key] = r.Version
+		} else if lock[r.Key] != nil { // keep failed service at its locked commit
+			outv[r.Key] = lock[r.Key]
+		}
+	}
 
-	if err := ioutil.WriteFile("up-lock.yaml", version, 0644); err != nil {
-		panic(err)
+	if err := writeLock(LockPath, outv); err != nil {
+		fmt.Println(color.RedString(("unable to write up-lock.yaml")))
+		return cli.NewExitError(err, -45)
 	}
 	fmt.Println(color.GreenString("up-lock.yaml are written"))
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d services failed to upgrade", failed, len(results)), -44)
+	}
 	return nil
 }
 
+// mergeService merges deploy.yaml of the service with its modification
+// files, layer by layer: <sname>.yaml, then <sname>.<env>.yaml and
+// common.<env>.yaml if env is set. Configs of the common overlay which
+// match nothing in this service are returned, since they may be used by
+// other services
+func mergeService(sname string, sver *Version, env string, noverify bool) ([]byte, []string, error) {
+	deploy, err := loadDeploy(sname, sver)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !noverify {
+		if err := verifyDeploy(sname, sver, deploy); err != nil {
+			return nil, nil, err
+		}
+		// name and version of the service come from service.yaml, saved
+		// next to deploy.yaml by up upgrade
+		body, err := loadService(sname, sver)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkService(sname, sver, body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// templates and annotations use the real name of the service, while
+	// the modification file is named after its key in up.yaml
+	commit := shortCommit(sver.Commit)
+	merged := []byte(compile(string(deploy), sver.Version, sver.Name, commit))
+	layers := []string{overlayPath(sname, "")}
+	if env != "" {
+		layers = append(layers, overlayPath(sname, env), overlayPath(CommonOverlay, env))
+	}
+
+	fmt.Printf("INFO: merging service %s (#%s)\n", sname, sver.Version)
+	var commonUnused []string
+	for _, layer := range layers {
+		moddeploy := readDeployModification(layer)
+		moddeploy = []byte(compile(string(moddeploy), sver.Version, sver.Name, commit))
+		out, unused, err := mergeLayer(moddeploy, merged, envNamespace(env))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", layer, err)
+		}
+		merged = out
+		if layer == overlayPath(CommonOverlay, env) {
+			commonUnused = unused
+			continue
+		}
+		for _, u := range unused {
+			fmt.Printf("WARN: %s: unused %s\n", layer, u)
+		}
+	}
+	merged, err = addVersionAnnotation(merged, sver.Version, sver.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, commonUnused, nil
+}
+
 func merge(c *cli.Context) error {
-	version, err := ioutil.ReadFile("up-lock.yaml")
-	if err != nil || string(version) == "" {
-		fmt.Println(color.RedString(("unable to read ./up-lock.yaml")))
-		return cli.NewExitError(err, -4)
+	env := c.String("env")
+	if err := checkEnv(env); err != nil {
+		return cli.NewExitError(err, -7)
 	}
+	lockpath := deployLockPath(env)
+	noverify := c.Bool("no-verify")
 
-	v := make(map[string]*Version) // version in map format
-	if err := yaml.Unmarshal(version, &v); err != nil {
-		fmt.Println(color.RedString(("wrong yaml")))
+	v, err := readVersions(LockPath)
+	if err != nil {
+		fmt.Println(color.RedString(("unable to read ./up-lock.yaml")))
 		return cli.NewExitError(err, -4)
 	}
 
+	results := make([]serviceResult, 0)
+	// number of services which do not use each config of the common overlay
+	commonUnused := make(map[string]int)
 	mutex := &sync.Mutex{}
 	// loop through version
 	// try to get original deploy.yaml in repo then merge it with devop
@@ -359,388 +864,310 @@ func merge(c *cli.Context) error {
 		wg.Add(1)
 		go func(sname string, sver *Version) {
 			defer wg.Done()
-			deploy := loadDeploy(sname)
-
-			deploy = []byte(compile(string(deploy), sver.Version, sname, sver.Commit[:7]))
-			moddeploy := readDeployModification(sname)
-			moddeploy = []byte(compile(string(moddeploy), sver.Version, sname, sver.Commit[:7]))
-
-			fmt.Printf("INFO: merging service %s (#%s)\n", sname, sver.Version)
-			merged := mergeYAML(moddeploy, deploy)
-			merged = addVersionAnnotation(merged, sver.Version, sname)
+			merged, unused, err := mergeService(sname, sver, env, noverify)
 			mutex.Lock()
-			outyaml = append(outyaml, "---\n"...)
-			outyaml = append(outyaml, merged...)
+			results = append(results, serviceResult{Key: sname, Version: sver, Err: err})
+			if err == nil {
+				outyaml = append(outyaml, "---\n"...)
+				outyaml = append(outyaml, merged...)
+				for _, u := range unused {
+					commonUnused[u]++
+				}
+			}
 			mutex.Unlock()
 		}(sname, sver)
 	}
 	wg.Wait()
 
-	outyaml = sortDeployment(outyaml)
-	if err := ioutil.WriteFile("deploy-lock.yaml", outyaml, 0644); err != nil {
-		fmt.Println(color.RedString(("unable to write deploy-lock.yaml")))
-		return cli.NewExitError(err, -5)
-	}
-	fmt.Println(color.GreenString("deploy-lock.yaml are written."))
-	return nil
-}
-
-func mergeNamedArray(x1, x2 []interface{}) interface{} {
-	out := make([]map[interface{}]interface{}, 0)
-	for _, e1 := range x1 {
-		e1, ok := e1.(map[interface{}]interface{})
-		if !ok {
-			return x1
-		}
-		name1, ok := e1["name"]
-		if !ok { // only merge array of name
-			return x1
-		}
-		// try to find x2 matching name
-		found := false
-		for i, e2 := range x2 {
-			e2, ok := e2.(map[interface{}]interface{})
-			if !ok {
-				return x1
-			}
-
-			name2, ok := e2["name"]
-			if !ok {
-				return x1
-			}
-			if name1 == name2 { // great, now merge
-				found = true
-				x2 = append(x2[:i], x2[i+1:]...)
-				out = append(out, mergeStruct(e1, e2).(map[interface{}]interface{}))
-				break
+	failed := printSummary(results)
+	if failed == 0 {
+		unused := make([]string, 0)
+		for u, n := range commonUnused {
+			if n == len(results) {
+				unused = append(unused, u)
 			}
 		}
-		if !found {
-			out = append(out, e1)
+		sort.Strings(unused)
+		for _, u := range unused {
+			fmt.Printf("WARN: %s: unused %s\n", overlayPath(CommonOverlay, env), u)
 		}
 	}
-	// add all remaining x2 elements to out
-	for _, e := range x2 {
-		e, ok := e.(map[interface{}]interface{})
-		if !ok {
-			break
-		}
-		out = append(out, e)
+	if failed > 0 && !c.Bool("keep-going") {
+		fmt.Println(color.RedString("%s is not written", lockpath))
+		return cli.NewExitError(fmt.Sprintf("%d of %d services failed to merge", failed, len(results)), -6)
 	}
-	return out
-}
 
-// merge 2 golang struct, x1's props overrides x2's props
-func mergeStruct(x1, x2 interface{}) interface{} {
-	switch x1 := x1.(type) {
-	case map[interface{}]interface{}:
-		x2, ok := x2.(map[interface{}]interface{})
-		if !ok {
-			return x1
-		}
-		for k, v2 := range x2 {
-			if v1, ok := x1[k]; ok {
-				x1[k] = mergeStruct(v1, v2)
-			} else {
-				x1[k] = v2
-			}
-		}
-	case nil:
-		return x2
-	case []interface{}:
-		x2, ok := x2.([]interface{})
-		if !ok {
-			return x1
-		}
-		return mergeNamedArray(x1, x2)
-	default:
-		return x1
+	outyaml, err = sortDeployment(outyaml)
+	if err != nil {
+		return cli.NewExitError(err, -5)
 	}
-	return x1
-}
-
-func getConfigNameAndKind(config map[interface{}]interface{}) (name, kind string) {
-	name = ""
-	kind, _ = config["kind"].(string)
-	if config["metadata"] == nil {
-		return
+	if err := ioutil.WriteFile(lockpath, outyaml, 0644); err != nil {
+		fmt.Println(color.RedString("unable to write %s", lockpath))
+		return cli.NewExitError(err, -5)
 	}
-
-	metadata, ok := config["metadata"].(map[interface{}]interface{})
-	if !ok {
-		return
+	fmt.Println(color.GreenString("%s are written.", lockpath))
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d services failed to merge", failed, len(results)), -6)
 	}
-
-	name, _ = metadata["name"].(string)
-	return
+	return nil
 }
 
 // merge 2 yaml structs, x1's props override x2's props
 // this function loop through all config in a and b (O(n^2))
 // very inefficient, but who case about few milliseconds
-func mergeYAML(a []byte, b []byte) (outyaml []byte) {
-	// split config into multiple config delimited by ---
-	asplit := RegSplit(string(a), "(?m:^[-]{3,})")
-	bsplit := RegSplit(string(b), "(?m:^[-]{3,})")
-	unuseds := make([]string, len(asplit)) // tell if there is some unused configs
-	copy(unuseds, asplit)
-	for _, cb := range bsplit {
-		yamlb, nb, kb := parseConfig(cb)
-		ismerged := false           // try to merge ca with cb if matched
-		for _, ca := range asplit { // should cache ca
-			yamla, na, ka := parseConfig(ca)
-			if na != nb || ka != kb {
-				continue
-			}
-			unuseds = removeString(unuseds, ca)
-			ret := mergeStruct(yamla, yamlb)
-			mergedyaml, err := yaml.Marshal(ret)
-			if err != nil {
-				panic(err)
-			}
-			outyaml = append(outyaml, "\n---\n"...)
-			outyaml = append(outyaml, mergedyaml...)
-			ismerged = true
-			break
-		}
-
-		if !ismerged { // still keep if not match
-			outyaml = append(outyaml, ("\n---\n" + cb)...)
-		}
+func mergeYAML(a []byte, b []byte) (outyaml []byte, err error) {
+	outyaml, unuseds, err := mergeLayer(a, b, DefaultNamespace)
+	if err != nil {
+		return nil, err
 	}
-
 	for _, unused := range unuseds {
-		if unused != "" {
-			_, name, kind := parseConfig(unused)
-			fmt.Printf("WARN: unused config kind %s, name %s\n", kind, name)
-		}
+		fmt.Printf("WARN: unused %s\n", unused)
 	}
-	return
+	return outyaml, nil
 }
 
-func addVersionAnnotation(inyaml []byte, version, service string) (outyaml []byte) {
-	// split config into multiple config delimited by ---
-	split := RegSplit(string(inyaml), "(?m:^[-]{3,})")
-	for _, config := range split {
-		config = strings.TrimSpace(config)
-		if config == "" {
+// mergeLayer merges modification a on top of b, configs without namespace are
+// in namespace ns. It also returns configs and patches of a which match
+// nothing in b
+func mergeLayer(a []byte, b []byte, ns string) (outyaml []byte, unused []string, err error) {
+	adocs, err := parseDocs(a)
+	if err != nil {
+		return nil, nil, fmt.Errorf("modification: invalid config: %v", err)
+	}
+	bdocs, err := parseDocs(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	// patches are applied after merging, so they are not merged as configs
+	patches := make([]*Patch, 0)
+	configs := make([]*yaml.Node, 0, len(adocs))
+	for _, yamla := range adocs {
+		if !isPatch(yamla) {
+			configs = append(configs, yamla)
 			continue
 		}
-		y := make(map[interface{}]interface{})
-		if err := yaml.Unmarshal([]byte(config), &y); err != nil {
-			panic(err)
-		}
-		metadata, _ := y["metadata"].(map[interface{}]interface{})
-		if metadata == nil {
-			metadata = make(map[interface{}]interface{})
-			y["metadata"] = metadata
+		patch, err := parsePatch(yamla)
+		if err != nil {
+			return nil, nil, fmt.Errorf("modification: %v", err)
 		}
+		patches = append(patches, patch)
+	}
 
-		annotations, _ := metadata["annotations"].(map[interface{}]interface{})
-		if annotations == nil {
-			annotations = make(map[interface{}]interface{})
-			metadata["annotations"] = annotations
+	used := make([]bool, len(configs)) // tell if there is some unused configs
+	out := make([]*yaml.Node, 0, len(bdocs))
+	for _, yamlb := range bdocs {
+		idb := getResourceID(yamlb)
+		merged := yamlb
+		deleted := false
+		for i, yamla := range configs {
+			if !getResourceID(yamla).matches(idb, ns) {
+				continue
+			}
+			used[i] = true
+			var keep bool
+			merged, keep = mergeConfig(yamla, yamlb, idb.Kind)
+			deleted = !keep
+			break
+		}
+		if deleted { // deleted by modification
+			continue
 		}
 
-		annotations["version"] = version
-		annotations["service"] = service
-		versionedyaml, err := yaml.Marshal(y)
-		if err != nil {
-			panic(err)
+		for _, patch := range patches {
+			if !patch.Target.matches(idb, ns) {
+				continue
+			}
+			patch.used = true
+			if merged, err = patch.apply(merged); err != nil {
+				return nil, nil, err
+			}
 		}
-		outyaml = append(outyaml, "\n---\n"...)
-		outyaml = append(outyaml, versionedyaml...)
+		out = append(out, merged)
 	}
-	return
-}
 
-// parseConfig parse kubernetes config content into yaml object, name of config and kind of config.
-func parseConfig(content string) (map[interface{}]interface{}, string, string) {
-	y := make(map[interface{}]interface{})
-	if err := yaml.Unmarshal([]byte(content), &y); err != nil {
-		panic(err)
+	for i, yamla := range configs {
+		if !used[i] {
+			unused = append(unused, fmt.Sprintf("config %s", getResourceID(yamla)))
+		}
 	}
-	name, kind := getConfigNameAndKind(y)
-	return y, name, kind
-}
-
-func kube(deploy []byte) {
-	// write deploy to temp file
-	tmpfile, err := ioutil.TempFile("", "deploy")
+	for _, patch := range patches {
+		if !patch.used {
+			unused = append(unused, fmt.Sprintf("patch of %s", patch.Target))
+		}
+	}
+	outyaml, err = marshalDocs(out)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	defer os.Remove(tmpfile.Name()) // clean up
+	return outyaml, unused, nil
+}
 
-	if _, err := tmpfile.Write(deploy); err != nil {
-		panic(err)
-	}
-	if err := tmpfile.Close(); err != nil {
-		panic(err)
-	}
+// ManagedByLabel is set on every config merged by up, so up drift can find
+// configs in the cluster which are no longer in the lock
+const ManagedByLabel = "app.kubernetes.io/managed-by"
 
-	var changedService = make(map[string]bool)
-	kinds, names, versions, services := getKubeConfigVersions(tmpfile.Name())
-	for i := range kinds {
-		vers, _ := getYamlConfigVersion(string(deploy), kinds[i], names[i])
-		if vers == versions[i] {
-			changedService[services[i]] = true
-		}
-	}
-
-	// call shell to apply kubernetes
-	cmd := exec.Command("kubectl", "apply", "-f", tmpfile.Name())
-	stdout, err := cmd.StdoutPipe()
+// addVersionAnnotation annotates configs with version and name of the service
+// and labels them as managed by up
+func addVersionAnnotation(inyaml []byte, version, service string) (outyaml []byte, err error) {
+	docs, err := parseDocs(inyaml)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid config: %v", err)
 	}
-	cmd.Start()
-
-	chunk := make([]byte, 10)
-	for {
-		if _, err := stdout.Read(chunk); err != nil {
-			break
+	for _, y := range docs {
+		if !isMap(y) {
+			return nil, fmt.Errorf("invalid config: not a map")
 		}
-		fmt.Print(chunk)
+		metadata := getOrAddMap(y, "metadata")
+		annotations := getOrAddMap(metadata, "annotations")
+		mapSet(annotations, "version", newString(version))
+		mapSet(annotations, "service", newString(service))
+		mapSet(getOrAddMap(metadata, "labels"), ManagedByLabel, newString(FieldManager))
 	}
+	return marshalDocs(docs)
 }
 
-func readDeployModification(sname string) []byte {
-	data, err := ioutil.ReadFile(sname + ".yaml")
+func readDeployModification(path string) []byte {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Printf("INFO: no modification deploy for service %s: %v\n", sname, err)
+		fmt.Printf("INFO: no modification file %s: %v\n", path, err)
 		return nil
 	}
 	//fmt.Printf("INFO: got modification deploy for service %s\n", sname)
 	return data
 }
 
-func getLatestCommit(repo, branch, us, pw string) string {
-	url := "https://api.bitbucket.org/2.0/repositories/" + repo + "/commits/" + branch + "?page=1&pagelen=2"
-	code, body := getHTTP(url, us, pw, nil)
-	if code != 200 {
-		panic("request to " + url + " not return 200, got " + strconv.Itoa(code))
-	}
+func readDeployYaml() string {
+	data, _ := ioutil.ReadFile("deploy.yaml")
+	return string(data)
+}
 
-	return gjson.Get(string(body), "values.0.hash").String()
+// http client
+var hclient = &fasthttp.Client{
+	MaxConnsPerHost: 100,
+	// keep escaped slashes in path, gitlab wants url-encoded project path
+	DisablePathNormalizing: true,
 }
 
-func getService(repo, commit, us, pw string) Service {
-	url := "https://bitbucket.org/" + repo + "/raw/" + commit + "/service.yaml"
-	code, body := getHTTP(url, us, pw, nil)
-	if code != 200 {
-		panic("request to " + url + " not return 200, got " + strconv.Itoa(code))
-	}
+// DefaultHTTPRetries is the number of retries of a failed request to a source
+// host
+const DefaultHTTPRetries = 3
 
-	s := Service{}
-	if err := yaml.Unmarshal(body, &s); err != nil {
-		panic(err)
-	}
-	return s
+const MaxHTTPBackoff = 1 * time.Minute
+
+// httpClient sends requests to source hosts, a failed request (network error,
+// 429 or 5xx) is retried Retries times, first retry waits Backoff, the wait is
+// doubled after each retry. A nil client retries DefaultHTTPRetries times
+type httpClient struct {
+	Retries int
+	Backoff time.Duration
 }
 
-func readDeployYaml() string {
-	data, _ := ioutil.ReadFile("deploy.yaml")
-	return string(data)
+// retriesFlag sets retries of commands requesting source hosts
+var retriesFlag = cli.IntFlag{
+	Name:  "retries",
+	Value: DefaultHTTPRetries,
+	Usage: "number of retries for a failed or rate-limited request",
 }
 
-func getDeployYaml(repo, commit, us, pw string) []byte {
-	url := "https://bitbucket.org/" + repo + "/raw/" + commit + "/deploy.yaml"
-	code, body := getHTTP(url, us, pw, nil)
+// forceConflictsFlag lets commands applying configs take over fields owned by
+// other field managers
+var forceConflictsFlag = cli.BoolFlag{
+	Name:  "force-conflicts",
+	Usage: "take over fields owned by other field managers, eg: replicas set by an autoscaler",
+}
 
-	if code != 200 {
-		panic("request to " + url + " not return 200, got " + strconv.Itoa(code))
-	}
-	return body
+func newHTTPClient(retries int) *httpClient {
+	return &httpClient{Retries: retries, Backoff: 1 * time.Second}
 }
 
-// http client
-var hclient = &fasthttp.Client{
-	MaxConnsPerHost: 100,
+// unreachableError is returned when a source host can not be reached at all,
+// as opposed to a host answering with an error
+type unreachableError struct{ err error }
+
+func (e *unreachableError) Error() string { return e.err.Error() }
+
+func (h *httpClient) get(fullurl, username, password string, header map[string]string) (int, []byte, error) {
+	if h == nil {
+		h = newHTTPClient(DefaultHTTPRetries)
+	}
+	for attempt := 0; ; attempt++ {
+		code, body, wait, err := doHTTP(fullurl, username, password, header)
+		retryable := err != nil || code == 429 || code >= 500
+		if !retryable || attempt >= h.Retries {
+			if err != nil {
+				return code, body, &unreachableError{err}
+			}
+			return code, body, err
+		}
+
+		if wait <= 0 {
+			wait = h.Backoff << uint(attempt)
+		}
+		if wait > MaxHTTPBackoff {
+			wait = MaxHTTPBackoff
+		}
+		if err != nil {
+			fmt.Printf("WARN: %v, retry in %s\n", err, wait)
+		} else {
+			fmt.Printf("WARN: request to %s got code %d, retry in %s\n", fullurl, code, wait)
+		}
+		time.Sleep(wait)
+	}
 }
 
-func getHTTP(fullurl, username, password string, header map[string]string) (int, []byte) {
+// doHTTP sends a GET request, returns code, body and the wait duration asked
+// by server's Retry-After header
+func doHTTP(fullurl, username, password string, header map[string]string) (int, []byte, time.Duration, error) {
 	timeout := 1 * time.Minute
 	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
 	req.SetRequestURI(fullurl)
 	req.Header.SetMethod("GET")
 
-	for k, v := range header {
-		req.Header.Set(k, v)
-	}
-
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.SetUserAgent("Subiz-Gun/4.012")
-	req.Header.Set("Authorization", toBasicAuth(username, password))
+	if username != "" || password != "" {
+		req.Header.Set("Authorization", toBasicAuth(username, password))
+	}
+
+	// caller's header overrides the defaults
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
 
 	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
 	if err := hclient.DoTimeout(req, res, timeout); err != nil {
-		panic(err)
+		return 0, nil, 0, fmt.Errorf("request to %s: %v", fullurl, err)
 	}
 
-	return res.StatusCode(), res.Body()
-}
-
-func toBasicAuth(username, password string) string {
-	authcode := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-	return "Basic " + authcode
-}
-
-func RegSplit(text string, delimeter string) []string {
-	reg := regexp.MustCompile(delimeter)
-	indexes := reg.FindAllStringIndex(text, -1)
-	laststart := 0
-	result := make([]string, len(indexes)+1)
-	for i, element := range indexes {
-		result[i] = text[laststart:element[0]]
-		laststart = element[1]
-	}
-	result[len(indexes)] = text[laststart:len(text)]
-	return result
+	wait := parseRetryAfter(string(res.Header.Peek("Retry-After")))
+	body := append([]byte(nil), res.Body()...)
+	return res.StatusCode(), body, wait, nil
 }
 
-func removeString(s []string, r string) []string {
-	for i, v := range s {
-		if v == r {
-			return append(s[:i], s[i+1:]...)
-		}
+// parseRetryAfter parses value of header Retry-After which is either a number
+// of seconds or a http date
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
 	}
-	return s
-}
-
-func getKubeConfigVersions(filename string) (kinds, names, versions, services []string) {
-	data, err := exec.Command("kubectl", "get", "-f", filename, "-o", "jsonpath={range .items[*]}{@.metadata.name}{\" \"}{@.kind}{\" \"}{@.metadata.annotations.version}{\" \"}{@.metadata.annotations.service}{\"\\n\"}{end}").Output()
-	if err != nil {
-		panic(err)
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
 	}
-	resources := strings.Split(string(data), "\n")
-	for _, r := range resources {
-		rsplit := strings.Split(r, " ")
-		if len(rsplit) < 3 {
-			continue
-		}
-		names = append(names, rsplit[0])
-		kinds = append(kinds, rsplit[1])
-		versions = append(versions, rsplit[2])
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
 	}
-	return
+	return 0
 }
 
-func getYamlConfigVersion(content, kind, name string) (string, string) {
-	configs := RegSplit(content, "(?m:^[-]{3,})")
-	for _, c := range configs {
-		y, n, k := parseConfig(c)
-		if n == name && k == kind {
-			if annos, ok := y["annotations"].(map[interface{}]interface{}); ok {
-				version, _ := annos["version"].(string)
-				service, _ := annos["service"].(string)
-				return version, service
-			}
-		}
-	}
-	return "", ""
+func toBasicAuth(username, password string) string {
+	authcode := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return "Basic " + authcode
 }
 
 func deploy(c *cli.Context) error {
@@ -770,7 +1197,7 @@ func inc(c *cli.Context) error {
 }
 
 func saveService(s Service) {
-	data, err := yaml.Marshal(&s)
+	data, err := marshalYAML(&s)
 	if err != nil {
 		panic(err)
 	}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
-	"gopkg.in/yaml.v2"
+	"time"
 )
 
 
@@ -39,31 +41,24 @@ a:
   k: 9
 `)
 
-	y1 := make(map[interface{}]interface{})
-	err := yaml.Unmarshal(f1, &y1)
+	y1, err := parseNode(string(f1))
 	if err != nil {
 		t.Fatalf("error :%v", err)
 	}
 
-	y2 := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(f2, &y2)
+	y2, err := parseNode(string(f2))
 	if err != nil {
 		t.Fatalf("error :%v", err)
 	}
 
-	yret := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(ret, &yret)
+	yret, err := parseNode(string(ret))
 	if err != nil {
 		t.Fatalf("error :%v", err)
 	}
 
-	y3 := mergeYAML(y1, y2)
-	err = yaml.Unmarshal(f2, &y2)
-	if err != nil {
-		t.Fatalf("error :%v", err)
-	}
-
-	if !compare(yret, y3) {
+	merged, _ := mergeConfig(y1, y2, "")
+	y3 := toValue(merged)
+	if !compare(toValue(yret), y3) {
 		t.Fatalf("should equal, got %v and %v", yret, y3)
 	}
 }
@@ -95,3 +90,52 @@ func compare(x1, x2 interface{}) bool {
 	}
 	return true
 }
+
+func TestGetHTTPRetry(t *testing.T) {
+	h := &httpClient{Retries: 3, Backoff: time.Millisecond}
+
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/limited" && calls < 3:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+		case r.URL.Path == "/limited":
+			w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(503)
+		}
+	}))
+	defer ts.Close()
+
+	code, body, err := h.get(ts.URL+"/limited", "", "", nil)
+	if err != nil || code != 200 || string(body) != "ok" {
+		t.Fatalf("should succeed after retries, got %d %s %v", code, body, err)
+	}
+	if calls != 3 {
+		t.Fatalf("should call 3 times, got %d", calls)
+	}
+
+	calls = 0
+	code, _, err = h.get(ts.URL+"/down", "", "", nil)
+	if err != nil || code != 503 {
+		t.Fatalf("should return last code, got %d %v", code, err)
+	}
+	if calls != 4 {
+		t.Fatalf("should call 4 times, got %d", calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Fatalf("should be 2m, got %s", d)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("should be about 1h, got %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("should be 0, got %s", d)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeKey tells which field identifies items of a list, so lists in
+// modification files are merged item by item, like patchMergeKey of kubernetes
+// strategic merge patch
+type mergeKey struct {
+	Kind string // kind of the config, empty matches all kinds
+	Path string // path of the list, matches the end of the full path
+	Key  string
+}
+
+// merge keys of lists, the first matched entry wins. Lists which are not in
+// the table are merged by name
+var mergeKeys = []mergeKey{
+	{Kind: "Service", Path: "spec.ports", Key: "port"},
+	{Path: "containers.ports", Key: "containerPort"},
+	{Path: "initContainers.ports", Key: "containerPort"},
+	{Path: "volumeMounts", Key: "mountPath"},
+	{Path: "volumeDevices", Key: "devicePath"},
+	{Path: "tolerations", Key: "key"},
+	{Path: "hostAliases", Key: "ip"},
+	{Path: "imagePullSecrets", Key: "name"},
+	{Path: "conditions", Key: "type"},
+}
+
+// directive in modification files, borrowed from kubernetes strategic merge
+// patch. "$patch: replace" in a map replaces the map instead of merging it, as
+// a list item it replaces the list by the other items. "$patch: delete" in a
+// list item deletes the matching item, in a map deletes the field holding the
+// map, in a config deletes the whole config
+const PatchDirective = "$patch"
+
+// removal markers in modification files. A field whose value is $delete is
+// removed from upstream, so are fields listed under the $delete key of a map.
+// $deleteFromPrimitiveList/<field> lists values to remove from list <field>.
+// Note that a null value (~) means "keep upstream", not delete
+const DeleteMarker = "$delete"
+const DeleteFromListPrefix = "$deleteFromPrimitiveList/"
+
+// merger merges a config of kind into another
+type merger struct {
+	kind string
+}
+
+// mergeConfig merges 2 configs of kind, x1's props overrides x2's props.
+// Order of keys, comments and style of x2 are kept, new keys of x1 are added
+// to the end. keep is false when x1 asks to delete the whole config
+func mergeConfig(x1, x2 *yaml.Node, kind string) (out *yaml.Node, keep bool) {
+	return merger{kind: kind}.merge(x1, x2, "")
+}
+
+func (m merger) merge(x1, x2 *yaml.Node, path string) (*yaml.Node, bool) {
+	x1, x2 = resolve(x1), resolve(x2)
+	switch x1.Kind {
+	case yaml.MappingNode:
+		switch nodeString(mapGet(x1, PatchDirective)) {
+		case "delete":
+			return nil, false
+		case "replace":
+			return m.clean(x1)
+		}
+		if !isMap(x2) {
+			return m.clean(x1)
+		}
+		out := *x2
+		out.Style = mergedStyle(x1, x2)
+		out.Content = append([]*yaml.Node{}, x2.Content...)
+		for i := 0; i+1 < len(x1.Content); i += 2 {
+			k, v1 := x1.Content[i], x1.Content[i+1]
+			if isDirectiveKey(k.Value) {
+				continue
+			}
+			v, keep := m.merge(v1, mapGet(x2, k.Value), joinPath(path, k.Value))
+			if !keep {
+				mapDelete(&out, k.Value)
+				continue
+			}
+			mapSetNode(&out, k, v)
+		}
+		applyDeletes(x1, &out)
+		return &out, true
+	case yaml.ScalarNode:
+		if isNull(x1) {
+			if x2 == nil {
+				return x1, true
+			}
+			return x2, true
+		}
+		if nodeString(x1) == DeleteMarker {
+			return nil, false
+		}
+		return keepComments(x1, x2), true
+	case yaml.SequenceNode:
+		if !isList(x2) {
+			return m.clean(x1)
+		}
+		return m.mergeList(x1, x2, path), true
+	}
+	return x1, true
+}
+
+// keepComments returns a copy of scalar x1 which overrides x2, comments of x2
+// are kept unless x1 has its own
+func keepComments(x1, x2 *yaml.Node) *yaml.Node {
+	if x2 == nil {
+		return x1
+	}
+	out := *x1
+	if out.HeadComment == "" {
+		out.HeadComment = x2.HeadComment
+	}
+	if out.LineComment == "" {
+		out.LineComment = x2.LineComment
+	}
+	if out.FootComment == "" {
+		out.FootComment = x2.FootComment
+	}
+	return &out
+}
+
+// mergedStyle returns the style of x2 merged with x1, an empty flow map or
+// list (eg: ports: []) takes the style of x1
+func mergedStyle(x1, x2 *yaml.Node) yaml.Style {
+	if len(x2.Content) == 0 {
+		return x1.Style
+	}
+	return x2.Style
+}
+
+// mergeList merges 2 lists item by item using the merge key of path, x1 is
+// kept wholesale if items can't be matched
+func (m merger) mergeList(x1, x2 *yaml.Node, path string) *yaml.Node {
+	items := make([]*yaml.Node, 0, len(x1.Content))
+	for _, e1 := range x1.Content {
+		if isPatchItem(e1, "replace") {
+			out, _ := m.clean(x1)
+			return out
+		}
+		items = append(items, resolve(e1))
+	}
+
+	key := m.mergeKey(path)
+	if !hasMergeKey(items, key) || !hasMergeKey(x2.Content, key) {
+		out, _ := m.clean(x1)
+		return out
+	}
+
+	rest := make([]*yaml.Node, len(x2.Content))
+	copy(rest, x2.Content)
+	out := *x2
+	out.Style = mergedStyle(x1, x2)
+	out.Content = make([]*yaml.Node, 0)
+	for _, e1 := range items {
+		// try to find x2 matching key
+		found := -1
+		for i, e2 := range rest {
+			if nodeEqual(mapGet(e2, key), mapGet(e1, key)) {
+				found = i
+				break
+			}
+		}
+
+		if nodeString(mapGet(e1, PatchDirective)) == "delete" {
+			if found >= 0 {
+				rest = append(rest[:found], rest[found+1:]...)
+			}
+			continue
+		}
+
+		if found < 0 {
+			if e, keep := m.clean(e1); keep {
+				out.Content = append(out.Content, e)
+			}
+			continue
+		}
+		e, _ := m.merge(e1, rest[found], path)
+		rest = append(rest[:found], rest[found+1:]...)
+		out.Content = append(out.Content, e)
+	}
+	// add all remaining x2 elements to out
+	out.Content = append(out.Content, rest...)
+	return &out
+}
+
+// mergeKey returns the key identifying items of the list at path
+func (m merger) mergeKey(path string) string {
+	for _, mk := range mergeKeys {
+		if mk.Kind != "" && mk.Kind != m.kind {
+			continue
+		}
+		if path == mk.Path || strings.HasSuffix(path, "."+mk.Path) {
+			return mk.Key
+		}
+	}
+	return "name"
+}
+
+// clean returns a copy of x without directives, x is taken from a
+// modification file without being merged. keep is false when x is asked to
+// be deleted
+func (m merger) clean(x *yaml.Node) (out *yaml.Node, keep bool) {
+	x = resolve(x)
+	switch x.Kind {
+	case yaml.MappingNode:
+		if nodeString(mapGet(x, PatchDirective)) == "delete" {
+			return nil, false
+		}
+		out := *x
+		out.Content = make([]*yaml.Node, 0, len(x.Content))
+		for i := 0; i+1 < len(x.Content); i += 2 {
+			if isDirectiveKey(x.Content[i].Value) {
+				continue
+			}
+			if v, keep := m.clean(x.Content[i+1]); keep {
+				out.Content = append(out.Content, x.Content[i], v)
+			}
+		}
+		return &out, true
+	case yaml.SequenceNode:
+		out := *x
+		out.Content = make([]*yaml.Node, 0, len(x.Content))
+		for _, e := range x.Content {
+			if isPatchItem(e, "replace") {
+				continue
+			}
+			if e, keep := m.clean(e); keep {
+				out.Content = append(out.Content, e)
+			}
+		}
+		return &out, true
+	case yaml.ScalarNode:
+		if nodeString(x) == DeleteMarker {
+			return nil, false
+		}
+	}
+	return x, true
+}
+
+func isDirectiveKey(k string) bool {
+	return k == PatchDirective || k == DeleteMarker || strings.HasPrefix(k, DeleteFromListPrefix)
+}
+
+// applyDeletes removes from out the fields and list values which directives
+// in modification x1 ask to delete
+func applyDeletes(x1, out *yaml.Node) {
+	if fields := mapGet(x1, DeleteMarker); isList(fields) {
+		for _, f := range resolve(fields).Content {
+			mapDelete(out, resolve(f).Value)
+		}
+	}
+
+	for i := 0; i+1 < len(x1.Content); i += 2 {
+		k := x1.Content[i].Value
+		if !strings.HasPrefix(k, DeleteFromListPrefix) {
+			continue
+		}
+		field := strings.TrimPrefix(k, DeleteFromListPrefix)
+		list, values := resolve(mapGet(out, field)), resolve(x1.Content[i+1])
+		if !isList(list) || !isList(values) {
+			continue
+		}
+		kept := *list
+		kept.Content = make([]*yaml.Node, 0, len(list.Content))
+		for _, e := range list.Content {
+			if !containsValue(values.Content, e) {
+				kept.Content = append(kept.Content, e)
+			}
+		}
+		mapSet(out, field, &kept)
+	}
+}
+
+func containsValue(list []*yaml.Node, v *yaml.Node) bool {
+	for _, e := range list {
+		if nodeEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPatchItem tells whether e is a list item containing only the directive
+// $patch: directive
+func isPatchItem(e *yaml.Node, directive string) bool {
+	e = resolve(e)
+	return isMap(e) && len(e.Content) == 2 && nodeString(mapGet(e, PatchDirective)) == directive
+}
+
+// hasMergeKey tells whether all items in list are maps having key
+func hasMergeKey(list []*yaml.Node, key string) bool {
+	for _, e := range list {
+		if mapGet(e, key) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func parseYAML(t *testing.T, s string) *yaml.Node {
+	y, err := parseNode(s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return y
+}
+
+func TestMergeConfig(t *testing.T) {
+	tcs := []struct {
+		desc, kind, mod, deploy, expect string
+	}{
+		{
+			"container ports are merged by containerPort",
+			"Deployment",
+			`
+spec:
+  template:
+    spec:
+      containers:
+      - name: user
+        ports:
+        - containerPort: 8080
+          name: http
+        - containerPort: 9090
+`,
+			`
+spec:
+  template:
+    spec:
+      containers:
+      - name: user
+        image: subiz/user
+        ports:
+        - containerPort: 8080
+          protocol: TCP
+        - containerPort: 7070
+`,
+			`
+spec:
+  template:
+    spec:
+      containers:
+      - name: user
+        image: subiz/user
+        ports:
+        - containerPort: 8080
+          name: http
+          protocol: TCP
+        - containerPort: 9090
+        - containerPort: 7070
+`,
+		},
+		{
+			"service ports are merged by port, volume mounts by mountPath",
+			"Service",
+			`
+spec:
+  ports:
+  - port: 80
+    targetPort: 8080
+  volumeMounts:
+  - mountPath: /data
+    readOnly: true
+`,
+			`
+spec:
+  ports:
+  - port: 80
+    name: http
+  volumeMounts:
+  - mountPath: /data
+    name: data
+`,
+			`
+spec:
+  ports:
+  - port: 80
+    name: http
+    targetPort: 8080
+  volumeMounts:
+  - mountPath: /data
+    name: data
+    readOnly: true
+`,
+		},
+		{
+			"$patch delete removes the item, $patch replace replaces the list",
+			"Deployment",
+			`
+containers:
+- name: sidecar
+  $patch: delete
+- name: user
+  args:
+  - $patch: replace
+  - --port=80
+env:
+- $patch: replace
+- name: A
+  value: "1"
+`,
+			`
+containers:
+- name: user
+  image: subiz/user
+- name: sidecar
+  image: envoy
+env:
+- name: B
+  value: "2"
+`,
+			`
+containers:
+- name: user
+  image: subiz/user
+  args:
+  - --port=80
+env:
+- name: A
+  value: "1"
+`,
+		},
+		{
+			"$patch replace replaces the map",
+			"Deployment",
+			`
+resources:
+  $patch: replace
+  limits:
+    cpu: 1
+`,
+			`
+resources:
+  limits:
+    memory: 1Gi
+  requests:
+    cpu: 100m
+`,
+			`
+resources:
+  limits:
+    cpu: 1
+`,
+		},
+		{
+			"list without merge key is kept",
+			"Deployment",
+			`
+args: [a, b]
+tolerations:
+- operator: Exists
+`,
+			`
+args: [c]
+tolerations:
+- key: node
+  operator: Equal
+`,
+			`
+args: [a, b]
+tolerations:
+- operator: Exists
+`,
+		},
+	}
+
+	for _, tc := range tcs {
+		out, keep := mergeConfig(parseYAML(t, tc.mod), parseYAML(t, tc.deploy), tc.kind)
+		if !keep {
+			t.Fatalf("%s: should keep config", tc.desc)
+		}
+		if expect := parseYAML(t, tc.expect); !reflect.DeepEqual(toValue(out), toValue(expect)) {
+			got, _ := marshalYAML(out)
+			t.Fatalf("%s: expect\n%s\ngot\n%s", tc.desc, tc.expect, got)
+		}
+	}
+
+	if _, keep := mergeConfig(parseYAML(t, "$patch: delete"), parseYAML(t, "kind: Service"), "Service"); keep {
+		t.Fatalf("config should be deleted")
+	}
+}
+
+func TestMergeConfigRemoval(t *testing.T) {
+	mod := `
+spec:
+  containers:
+  - name: user
+    resources:
+      limits: $delete
+    livenessProbe:
+      $patch: delete
+    $delete: [readinessProbe]
+    $deleteFromPrimitiveList/args: [--debug]
+    env: ~
+  - name: sidecar
+    $patch: delete
+  - name: logger
+    image: fluentd
+    command: $delete
+`
+	deploy := `
+spec:
+  containers:
+  - name: user
+    args: [--port=80, --debug]
+    env:
+    - name: A
+      value: "1"
+    resources:
+      limits:
+        cpu: 1
+      requests:
+        cpu: 100m
+    livenessProbe:
+      tcpSocket:
+        port: 80
+    readinessProbe:
+      tcpSocket:
+        port: 80
+  - name: sidecar
+    image: envoy
+`
+	expect := `
+spec:
+  containers:
+  - name: user
+    args: [--port=80]
+    env:
+    - name: A
+      value: "1"
+    resources:
+      requests:
+        cpu: 100m
+  - name: logger
+    image: fluentd
+`
+	out, _ := mergeConfig(parseYAML(t, mod), parseYAML(t, deploy), "Pod")
+	if !reflect.DeepEqual(toValue(out), toValue(parseYAML(t, expect))) {
+		got, _ := marshalYAML(out)
+		t.Fatalf("expect\n%s\ngot\n%s", expect, got)
+	}
+}
+
+func TestMergeYAMLKeepsFormatting(t *testing.T) {
+	mod := `
+kind: Service
+metadata:
+  name: user
+spec:
+  type: NodePort # exposed for the lb
+`
+	deploy := `
+# user service
+kind: Service
+metadata:
+  name: user # the name
+spec:
+  selector:
+    app: user
+  type: ClusterIP
+  ports: []
+  externalIPs: ~
+`
+	out, err := mergeYAML([]byte(mod), []byte(deploy))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expect := `# user service
+kind: Service
+metadata:
+  name: user # the name
+spec:
+  selector:
+    app: user
+  type: NodePort # exposed for the lb
+  ports: []
+  externalIPs: ~
+`
+	if string(out) != expect {
+		t.Fatalf("expect\n%s\ngot\n%s", expect, out)
+	}
+}
+
+func TestMergeYAMLDocuments(t *testing.T) {
+	mod := `--- # replicas
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 2
+...
+`
+	deploy := `---
+---
+kind: ConfigMap
+metadata:
+  name: user
+data:
+  config: |
+    a: 1
+    ---
+    b: 2
+---
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 1
+---
+# nothing here
+`
+	out, err := mergeYAML([]byte(mod), []byte(deploy))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	docs, err := parseDocs(out)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("should have 2 configs, got %s", out)
+	}
+	if config := nodeString(getIn(docs[0], "data.config")); config != "a: 1\n---\nb: 2\n" {
+		t.Fatalf("block scalar should be kept, got %q", config)
+	}
+	if replicas := getIn(docs[1], "spec.replicas"); replicas == nil || replicas.Value != "2" {
+		t.Fatalf("deployment should be merged, got %s", out)
+	}
+}
+
+func TestMergeYAMLNamespaces(t *testing.T) {
+	mod := `
+kind: ConfigMap
+metadata:
+  name: user
+  namespace: kube-system
+data:
+  a: "2"
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 5
+`
+	deploy := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: user
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: user
+  namespace: kube-system
+data:
+  a: "1"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 1
+`
+	out, unused, err := mergeLayer([]byte(mod), []byte(deploy), "default")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	docs, _ := parseDocs(out)
+	if len(docs) != 3 {
+		t.Fatalf("should have 3 configs, got %s", out)
+	}
+	if a := nodeString(getIn(docs[0], "data.a")); a != "1" {
+		t.Fatalf("configmap in default namespace should not be merged, got %s", out)
+	}
+	if a := nodeString(getIn(docs[1], "data.a")); a != "2" {
+		t.Fatalf("configmap in kube-system should be merged, got %s", out)
+	}
+	if len(unused) != 1 || unused[0] != "config Deployment.extensions/user" {
+		t.Fatalf("deployment of other group should be unused, got %v", unused)
+	}
+
+	// same config in the default namespace of the environment
+	mod = "kind: ConfigMap\nmetadata:\n  name: user\ndata:\n  a: \"3\"\n"
+	out, _, err = mergeLayer([]byte(mod), []byte(deploy), "kube-system")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	docs, _ = parseDocs(out)
+	if a := nodeString(getIn(docs[1], "data.a")); a != "3" {
+		t.Fatalf("configmap in kube-system should be merged, got %s", out)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// marshalYAML marshals v with 2 spaces indentation
+func marshalYAML(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseNode parses a yaml document, returns its root node or nil if the
+// document is empty
+func parseNode(content string) (*yaml.Node, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(content), doc); err != nil {
+		return nil, err
+	}
+	return docRoot(doc), nil
+}
+
+// parseDocs parses all documents of a multi-document yaml, returns root nodes
+// of documents which are not empty
+func parseDocs(data []byte) ([]*yaml.Node, error) {
+	docs := make([]*yaml.Node, 0)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		doc := &yaml.Node{}
+		err := dec.Decode(doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if root := docRoot(doc); root != nil {
+			docs = append(docs, root)
+		}
+	}
+}
+
+// marshalDocs marshals nodes into a multi-document yaml
+func marshalDocs(docs []*yaml.Node) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// docRoot returns root node of document doc, nil if the document is empty
+// or null. Comments of the document are moved to the root node so they are
+// kept when the root is marshaled
+func docRoot(doc *yaml.Node) *yaml.Node {
+	if len(doc.Content) == 0 || isNull(doc.Content[0]) {
+		return nil
+	}
+	root := doc.Content[0]
+	root.HeadComment = joinComments(doc.HeadComment, root.HeadComment)
+	root.FootComment = joinComments(root.FootComment, doc.FootComment)
+	return root
+}
+
+func joinComments(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "\n\n" + b
+}
+
+// resolve follows alias n to the node it refers to
+func resolve(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+func isMap(n *yaml.Node) bool {
+	n = resolve(n)
+	return n != nil && n.Kind == yaml.MappingNode
+}
+
+func isList(n *yaml.Node) bool {
+	n = resolve(n)
+	return n != nil && n.Kind == yaml.SequenceNode
+}
+
+func isNull(n *yaml.Node) bool {
+	n = resolve(n)
+	return n != nil && n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+// nodeString returns value of scalar n, empty if n is not a string
+func nodeString(n *yaml.Node) string {
+	n = resolve(n)
+	if n == nil || n.Kind != yaml.ScalarNode || n.ShortTag() != "!!str" {
+		return ""
+	}
+	return n.Value
+}
+
+func newString(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func newMap() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+// mapIndex returns index of value of key in map n, -1 if not found
+func mapIndex(n *yaml.Node, key string) int {
+	n = resolve(n)
+	if n == nil || n.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// mapGet returns value of key in map n, nil if not found
+func mapGet(n *yaml.Node, key string) *yaml.Node {
+	i := mapIndex(n, key)
+	if i < 0 {
+		return nil
+	}
+	return resolve(n).Content[i]
+}
+
+// mapSet sets key of map n to v, a new key is added to the end of the map
+func mapSet(n *yaml.Node, key string, v *yaml.Node) {
+	n = resolve(n)
+	if i := mapIndex(n, key); i >= 0 {
+		n.Content[i] = v
+		return
+	}
+	n.Content = append(n.Content, newString(key), v)
+}
+
+// mapSetNode is mapSet with the key node of a map, so comments and style of
+// the key are kept when it is added
+func mapSetNode(n *yaml.Node, key, v *yaml.Node) {
+	n = resolve(n)
+	if i := mapIndex(n, key.Value); i >= 0 {
+		n.Content[i] = v
+		return
+	}
+	n.Content = append(n.Content, key, v)
+}
+
+func mapDelete(n *yaml.Node, key string) {
+	n = resolve(n)
+	if i := mapIndex(n, key); i >= 0 {
+		n.Content = append(n.Content[:i-1:i-1], n.Content[i+1:]...)
+	}
+}
+
+// getIn returns the value at dotted path in map n, eg: metadata.name
+func getIn(n *yaml.Node, path string) *yaml.Node {
+	for _, key := range strings.Split(path, ".") {
+		if n = mapGet(n, key); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// getOrAddMap returns map at key of map n, adds it if missing
+func getOrAddMap(n *yaml.Node, key string) *yaml.Node {
+	v := resolve(mapGet(n, key))
+	if v == nil || v.Kind != yaml.MappingNode {
+		v = newMap()
+		mapSet(n, key, v)
+	}
+	return v
+}
+
+// copyNode deep copies n, aliases are resolved
+func copyNode(n *yaml.Node) *yaml.Node {
+	n = resolve(n)
+	if n == nil {
+		return nil
+	}
+	out := *n
+	if n.Content != nil {
+		out.Content = make([]*yaml.Node, len(n.Content))
+		for i, c := range n.Content {
+			out.Content[i] = copyNode(c)
+		}
+	}
+	return &out
+}
+
+// nodeEqual tells whether a and b hold the same value, regardless of style
+// and comments
+func nodeEqual(a, b *yaml.Node) bool {
+	a, b = resolve(a), resolve(b)
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Kind != b.Kind || len(a.Content) != len(b.Content) {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode {
+		return a.ShortTag() == b.ShortTag() && a.Value == b.Value
+	}
+	if a.Kind == yaml.MappingNode {
+		for i := 0; i < len(a.Content); i += 2 {
+			if !nodeEqual(a.Content[i+1], mapGet(b, a.Content[i].Value)) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range a.Content {
+		if !nodeEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// toValue converts n into golang values, maps are map[interface{}]interface{}
+func toValue(n *yaml.Node) interface{} {
+	n = resolve(n)
+	if n == nil {
+		return nil
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil
+		}
+		return toValue(n.Content[0])
+	case yaml.MappingNode:
+		out := make(map[interface{}]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			out[toValue(n.Content[i])] = toValue(n.Content[i+1])
+		}
+		return out
+	case yaml.SequenceNode:
+		out := make([]interface{}, len(n.Content))
+		for i, c := range n.Content {
+			out[i] = toValue(c)
+		}
+		return out
+	}
+	var v interface{}
+	n.Decode(&v)
+	return v
+}
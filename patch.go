@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PatchKind is kind of configs in modification files which patch an upstream
+// config instead of being merged into it:
+//
+//	kind: Patch
+//	target:
+//	  apiVersion: apps/v1 # optional
+//	  kind: Deployment
+//	  namespace: default # optional
+//	  name: user
+//	mergePatch: # RFC 7386 JSON merge patch
+//	  spec:
+//	    replicas: 3
+//	jsonPatch: # RFC 6902 JSON patch
+//	- op: add
+//	  path: /spec/template/spec/containers/0/args/0
+//	  value: --debug
+//
+// mergePatch is applied before jsonPatch
+const PatchKind = "Patch"
+
+// Patch is a config of kind Patch in a modification file
+type Patch struct {
+	Target     resourceID
+	MergePatch *yaml.Node
+	JSONPatch  []*yaml.Node
+	used       bool
+}
+
+// isPatch tells whether config y is a Patch
+func isPatch(y *yaml.Node) bool {
+	return nodeString(mapGet(y, "kind")) == PatchKind && mapGet(y, "target") != nil
+}
+
+func parsePatch(y *yaml.Node) (*Patch, error) {
+	target := mapGet(y, "target")
+	if !isMap(target) {
+		return nil, fmt.Errorf("target of patch must be a map of kind and name")
+	}
+	p := &Patch{MergePatch: mapGet(y, "mergePatch")}
+	p.Target = resourceID{
+		Kind:      nodeString(mapGet(target, "kind")),
+		Namespace: nodeString(mapGet(target, "namespace")),
+		Name:      nodeString(mapGet(target, "name")),
+	}
+	p.Target.setAPIVersion(nodeString(mapGet(target, "apiVersion")))
+	if p.Target.Kind == "" || p.Target.Name == "" {
+		return nil, fmt.Errorf("target of patch must have kind and name")
+	}
+	if ops := mapGet(y, "jsonPatch"); ops != nil {
+		if !isList(ops) {
+			return nil, fmt.Errorf("jsonPatch of patch %s must be a list of operations", p.Target)
+		}
+		p.JSONPatch = resolve(ops).Content
+	}
+	return p, nil
+}
+
+// applyPatch applies merge patch then json patch of p to doc
+func (p *Patch) apply(doc *yaml.Node) (*yaml.Node, error) {
+	if p.MergePatch != nil && !isNull(p.MergePatch) {
+		doc = mergePatch(doc, p.MergePatch)
+	}
+	doc, err := jsonPatch(doc, p.JSONPatch)
+	if err != nil {
+		return nil, fmt.Errorf("patch %s: %v", p.Target, err)
+	}
+	return doc, nil
+}
+
+// mergePatch applies a RFC 7386 JSON merge patch to target
+func mergePatch(target, patch *yaml.Node) *yaml.Node {
+	patch = resolve(patch)
+	if !isMap(patch) {
+		return copyNode(patch)
+	}
+	target = resolve(target)
+	if !isMap(target) {
+		target = newMap()
+	}
+	for i := 0; i+1 < len(patch.Content); i += 2 {
+		k, v := patch.Content[i].Value, patch.Content[i+1]
+		if isNull(v) {
+			mapDelete(target, k)
+			continue
+		}
+		mapSet(target, k, mergePatch(mapGet(target, k), v))
+	}
+	return target
+}
+
+// jsonPatch applies RFC 6902 JSON patch operations to doc
+func jsonPatch(doc *yaml.Node, ops []*yaml.Node) (*yaml.Node, error) {
+	for i, op := range ops {
+		if !isMap(op) {
+			return nil, fmt.Errorf("operation %d must be a map", i)
+		}
+		name := nodeString(mapGet(op, "op"))
+		path := resolve(mapGet(op, "path"))
+		if path == nil || path.ShortTag() != "!!str" {
+			return nil, fmt.Errorf("operation %d (%s) has no path", i, name)
+		}
+		pointer := path.Value
+		value := mapGet(op, "value")
+		from := nodeString(mapGet(op, "from"))
+
+		var err error
+		switch name {
+		case "add":
+			if value == nil {
+				return nil, fmt.Errorf("operation %d (add %s) has no value", i, pointer)
+			}
+			doc, err = pointerAdd(doc, pointer, copyNode(value))
+		case "remove":
+			doc, _, err = pointerRemove(doc, pointer)
+		case "replace":
+			if value == nil {
+				return nil, fmt.Errorf("operation %d (replace %s) has no value", i, pointer)
+			}
+			if _, err = pointerGet(doc, pointer); err == nil {
+				doc, err = pointerReplace(doc, pointer, copyNode(value))
+			}
+		case "move":
+			var v *yaml.Node
+			if doc, v, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, pointer, v)
+			}
+		case "copy":
+			var v *yaml.Node
+			if v, err = pointerGet(doc, from); err == nil {
+				doc, err = pointerAdd(doc, pointer, copyNode(v))
+			}
+		case "test":
+			var v *yaml.Node
+			if v, err = pointerGet(doc, pointer); err == nil && !nodeEqual(v, value) {
+				err = fmt.Errorf("test failed, value at %s is %v, not %v", pointer, toValue(v), toValue(value))
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %v", i, name, pointer, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a RFC 6901 JSON pointer into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// listIndex parses token as an index of list, end allows index len(list)
+func listIndex(list *yaml.Node, token string, end bool) (int, error) {
+	n := len(list.Content)
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) {
+		return 0, fmt.Errorf("invalid index %s of list of %d items", token, n)
+	}
+	return i, nil
+}
+
+// child returns the value of token in map or list n
+func child(n *yaml.Node, token string) (*yaml.Node, error) {
+	n = resolve(n)
+	switch {
+	case isMap(n):
+		if v := mapGet(n, token); v != nil {
+			return resolve(v), nil
+		}
+	case isList(n):
+		i, err := listIndex(n, token, false)
+		if err != nil {
+			return nil, err
+		}
+		return resolve(n.Content[i]), nil
+	}
+	return nil, fmt.Errorf("%s not found", token)
+}
+
+func pointerGet(doc *yaml.Node, pointer string) (*yaml.Node, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if doc, err = child(doc, t); err != nil {
+			return nil, fmt.Errorf("%s not found", pointer)
+		}
+	}
+	return doc, nil
+}
+
+// pointerParent returns the parent of the value at pointer and the last token
+// of pointer, pointer must not be empty
+func pointerParent(doc *yaml.Node, pointer string) (*yaml.Node, string, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, t := range tokens[:len(tokens)-1] {
+		if doc, err = child(doc, t); err != nil {
+			return nil, "", err
+		}
+	}
+	return resolve(doc), tokens[len(tokens)-1], nil
+}
+
+func pointerAdd(doc *yaml.Node, pointer string, value *yaml.Node) (*yaml.Node, error) {
+	if pointer == "" {
+		return value, nil
+	}
+	parent, token, err := pointerParent(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isMap(parent):
+		mapSet(parent, token, value)
+	case isList(parent):
+		i, err := listIndex(parent, token, true)
+		if err != nil {
+			return nil, err
+		}
+		parent.Content = append(parent.Content, nil)
+		copy(parent.Content[i+1:], parent.Content[i:])
+		parent.Content[i] = value
+	default:
+		return nil, fmt.Errorf("parent of %s is not a map or a list", pointer)
+	}
+	return doc, nil
+}
+
+func pointerReplace(doc *yaml.Node, pointer string, value *yaml.Node) (*yaml.Node, error) {
+	if pointer == "" {
+		return value, nil
+	}
+	parent, token, err := pointerParent(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isMap(parent):
+		mapSet(parent, token, value)
+	case isList(parent):
+		i, err := listIndex(parent, token, false)
+		if err != nil {
+			return nil, err
+		}
+		parent.Content[i] = value
+	default:
+		return nil, fmt.Errorf("parent of %s is not a map or a list", pointer)
+	}
+	return doc, nil
+}
+
+// pointerRemove removes the value at pointer, returns the updated doc and the
+// removed value
+func pointerRemove(doc *yaml.Node, pointer string) (*yaml.Node, *yaml.Node, error) {
+	if pointer == "" {
+		return nil, nil, fmt.Errorf("cannot remove the whole config")
+	}
+	parent, token, err := pointerParent(doc, pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := child(parent, token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s not found", pointer)
+	}
+	if isMap(parent) {
+		mapDelete(parent, token)
+	} else {
+		i, _ := listIndex(parent, token, false)
+		parent.Content = append(parent.Content[:i:i], parent.Content[i+1:]...)
+	}
+	return doc, removed, nil
+}
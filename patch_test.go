@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONPatch(t *testing.T) {
+	doc := parseYAML(t, `
+spec:
+  replicas: 1
+  containers:
+  - name: user
+    args: [--port=80]
+  labels:
+    a/b: x
+`)
+	ops := parseYAML(t, `
+- op: test
+  path: /spec/replicas
+  value: 1
+- op: replace
+  path: /spec/replicas
+  value: 3
+- op: add
+  path: /spec/containers/0/args/0
+  value: --debug
+- op: add
+  path: /spec/containers/0/args/-
+  value: --verbose
+- op: copy
+  from: /spec/containers/0
+  path: /spec/containers/-
+- op: replace
+  path: /spec/containers/1/name
+  value: sidecar
+- op: move
+  from: /spec/labels/a~1b
+  path: /spec/labels/c
+- op: remove
+  path: /spec/containers/1/args/1
+`).Content
+
+	out, err := jsonPatch(doc, ops)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expect := parseYAML(t, `
+spec:
+  replicas: 3
+  containers:
+  - name: user
+    args: [--debug, --port=80, --verbose]
+  - name: sidecar
+    args: [--debug, --verbose]
+  labels:
+    c: x
+`)
+	if !reflect.DeepEqual(toValue(out), toValue(expect)) {
+		got, _ := marshalYAML(out)
+		t.Fatalf("got\n%s", got)
+	}
+
+	failures := []string{
+		"[{op: test, path: /spec/replicas, value: 5}]",
+		"[{op: remove, path: /spec/missing}]",
+		"[{op: replace, path: /spec/containers/9, value: 1}]",
+		"[{op: add, path: spec, value: 1}]",
+		"[{op: jump, path: /spec}]",
+	}
+	for _, f := range failures {
+		if _, err := jsonPatch(out, parseYAML(t, f).Content); err == nil {
+			t.Fatalf("%s should fail", f)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	out := mergePatch(parseYAML(t, "{a: b, c: {d: e, f: g}, l: [1, 2]}"), parseYAML(t, "{a: z, c: {f: ~}, l: [3], n: {x: 1}}"))
+	if expect := parseYAML(t, "{a: z, c: {d: e}, l: [3], n: {x: 1}}"); !reflect.DeepEqual(toValue(out), toValue(expect)) {
+		t.Fatalf("expect %v, got %v", expect, out)
+	}
+}
+
+func TestMergeYAMLWithPatch(t *testing.T) {
+	mod := `
+kind: Patch
+target:
+  kind: Deployment
+  name: user
+mergePatch:
+  spec:
+    replicas: 2
+jsonPatch:
+- op: add
+  path: /spec/args/1
+  value: --b
+---
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 5
+`
+	deploy := `
+kind: Deployment
+metadata:
+  name: user
+spec:
+  replicas: 1
+  args: [--a, --c]
+---
+kind: Service
+metadata:
+  name: user
+`
+	out, err := mergeYAML([]byte(mod), []byte(deploy))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if !strings.Contains(string(out), "replicas: 2") || !strings.Contains(string(out), "args: [--a, --b, --c]") {
+		t.Fatalf("patch should be applied after merging, got %s", out)
+	}
+	if !strings.Contains(string(out), "kind: Service") || strings.Contains(string(out), "kind: Patch") {
+		t.Fatalf("wrong output, got %s", out)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceProvider reads service repositories from a source host (bitbucket,
+// github, ...). Each entry in up.yaml picks its provider using the host field.
+type SourceProvider interface {
+	// GetLatestCommit resolves branch to the hash of its latest commit
+	GetLatestCommit(repo, branch string) (string, error)
+
+	// GetFile returns content of the file at path in repo at commit
+	GetFile(repo, commit, path string) ([]byte, error)
+}
+
+// Commit is a commit in the history of a repository
+type Commit struct {
+	Hash, Author, Message string
+}
+
+// CommitLister is implemented by source providers which can list commits
+// between two commits
+type CommitLister interface {
+	// ListCommits returns commits reachable from to but not from from,
+	// newest first
+	ListCommits(repo, from, to string) ([]Commit, error)
+}
+
+// max number of commits returned by ListCommits
+const MaxCommits = 100
+
+// listCommits returns commits between from and to if the provider supports it
+func listCommits(p SourceProvider, repo, from, to string) ([]Commit, error) {
+	if c, ok := p.(*cachedProvider); ok {
+		p = c.SourceProvider
+	}
+	lister, ok := p.(CommitLister)
+	if !ok {
+		return nil, fmt.Errorf("listing commits is not supported for repo %s", repo)
+	}
+	return lister.ListCommits(repo, from, to)
+}
+
+// firstLine returns the first line of a commit message
+func firstLine(message string) string {
+	return strings.TrimSpace(strings.SplitN(strings.TrimSpace(message), "\n", 2)[0])
+}
+
+// reverseCommits reverses commits in place, used for hosts returning the
+// oldest commit first
+func reverseCommits(commits []Commit) []Commit {
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits
+}
+
+// isBitbucket tells whether an entry in up.yaml is fetched from bitbucket
+func isBitbucket(host, repo string) bool {
+	return host == "bitbucket" || host == "" && !isLocalRepo(repo)
+}
+
+// getProvider returns the source provider for an entry in up.yaml, an empty
+// host means bitbucket, or local git when repo is a path
+func getProvider(host, repo string, h *httpClient) (SourceProvider, error) {
+	if host == "" && isLocalRepo(repo) {
+		host = "git"
+	}
+
+	switch host {
+	case "git": // already on disk, no need to cache
+		return &LocalGit{}, nil
+	case "", "bitbucket":
+		return withCache(&Bitbucket{User: gconfig.Bbuser, Pass: gconfig.Bbpass, HTTP: h}, "bitbucket"), nil
+	case "github":
+		return withCache(newGithub(h), host), nil
+	case "gitlab":
+		return withCache(newGitlab(h), host), nil
+	case "gitea":
+		g, err := newGitea(h)
+		if err != nil {
+			return nil, err
+		}
+		return withCache(g, host), nil
+	}
+	return nil, fmt.Errorf("unknown host %q", host)
+}
+
+func getService(p SourceProvider, repo, commit string) (Service, error) {
+	body, err := p.GetFile(repo, commit, "service.yaml")
+	if err != nil {
+		return Service{}, err
+	}
+	return unmarshalService(repo, body)
+}
+
+func unmarshalService(repo string, body []byte) (Service, error) {
+	s := Service{}
+	if err := yaml.Unmarshal(body, &s); err != nil {
+		return s, fmt.Errorf("invalid service.yaml in repo %s: %v", repo, err)
+	}
+	return s, nil
+}
+
+// sha256sum returns hex encoded sha256 of data, used as integrity hash of
+// files in up-lock.yaml
+func sha256sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func getDeployYaml(p SourceProvider, repo, commit string) ([]byte, error) {
+	return p.GetFile(repo, commit, "deploy.yaml")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitlabAndGiteaProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/subiz%2Fbackend%2Fuser/repository/branches/release%2F4":
+			if r.Header.Get("PRIVATE-TOKEN") != "lab" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"name": "release/4", "commit": {"id": "aaa111"}}`))
+		case "/api/v4/projects/subiz%2Fbackend%2Fuser/repository/files/deploy.yaml/raw":
+			if r.URL.Query().Get("ref") != "aaa111" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte("kind: Service\n"))
+		case "/api/v1/repos/subiz/user/branches/master":
+			if r.Header.Get("Authorization") != "token tea" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"name": "master", "commit": {"id": "bbb222"}}`))
+		case "/api/v1/repos/subiz/user/raw/deploy.yaml":
+			if r.URL.Query().Get("ref") != "bbb222" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte("kind: Deployment\n"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	tcs := []struct {
+		provider     SourceProvider
+		repo, branch string
+		commit, kind string
+	}{
+		{&Gitlab{URL: ts.URL, Token: "lab"}, "subiz/backend/user", "release/4", "aaa111", "kind: Service\n"},
+		{&Gitea{URL: ts.URL, Token: "tea"}, "subiz/user", "master", "bbb222", "kind: Deployment\n"},
+	}
+	for _, tc := range tcs {
+		commit, err := tc.provider.GetLatestCommit(tc.repo, tc.branch)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if commit != tc.commit {
+			t.Fatalf("wrong commit for %s, expect %s, got %s", tc.repo, tc.commit, commit)
+		}
+
+		deploy, err := getDeployYaml(tc.provider, tc.repo, commit)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if string(deploy) != tc.kind {
+			t.Fatalf("wrong deploy.yaml for %s, got %q", tc.repo, deploy)
+		}
+	}
+}
+
+func TestIsBitbucket(t *testing.T) {
+	if !isBitbucket("", "subiz/user") || !isBitbucket("bitbucket", "subiz/user") {
+		t.Fatalf("entries without host should use bitbucket")
+	}
+	if isBitbucket("github", "subiz/user") || isBitbucket("", "./user") {
+		t.Fatalf("github and local repos should not use bitbucket")
+	}
+}
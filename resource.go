@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultNamespace is the namespace of configs which have none, unless the
+// environment or the kubeconfig context has its own, eg: up config
+// prod_namespace production
+const DefaultNamespace = "default"
+
+// resourceID identifies a kubernetes config
+type resourceID struct {
+	Group, Kind, Namespace, Name string
+
+	// config has no apiVersion, which is common in modification files,
+	// it matches configs of any group
+	anyGroup bool
+}
+
+// getResourceID returns identity of config, namespace is empty if config has
+// none
+func getResourceID(config *yaml.Node) resourceID {
+	id := resourceID{
+		Kind:      nodeString(mapGet(config, "kind")),
+		Namespace: nodeString(getIn(config, "metadata.namespace")),
+		Name:      nodeString(getIn(config, "metadata.name")),
+	}
+	id.setAPIVersion(nodeString(mapGet(config, "apiVersion")))
+	return id
+}
+
+// setAPIVersion sets group of id from apiVersion, eg: apps/v1, the core group
+// (apiVersion: v1) is empty
+func (id *resourceID) setAPIVersion(apiVersion string) {
+	id.anyGroup = apiVersion == ""
+	id.Group = ""
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		id.Group = apiVersion[:i]
+	}
+}
+
+// matches tells whether id and other identify the same config, configs
+// without namespace are in namespace ns
+func (id resourceID) matches(other resourceID, ns string) bool {
+	if id.Kind != other.Kind || id.Name != other.Name {
+		return false
+	}
+	if id.Group != other.Group && !id.anyGroup && !other.anyGroup {
+		return false
+	}
+	return id.namespace(ns) == other.namespace(ns)
+}
+
+func (id resourceID) namespace(ns string) string {
+	if id.Namespace == "" {
+		return ns
+	}
+	return id.Namespace
+}
+
+// String returns id in form kind.group/namespace/name, group and namespace
+// are omitted if empty, eg: Deployment.apps/user
+func (id resourceID) String() string {
+	s := id.Kind
+	if id.Group != "" {
+		s += "." + id.Group
+	}
+	if id.Namespace != "" {
+		s += "/" + id.Namespace
+	}
+	return s + "/" + id.Name
+}
+
+// less orders configs by name, kind, namespace then group
+func (id resourceID) less(other resourceID) bool {
+	if id.Name != other.Name {
+		return id.Name < other.Name
+	}
+	if id.Kind != other.Kind {
+		return id.Kind < other.Kind
+	}
+	if id.Namespace != other.Namespace {
+		return id.Namespace < other.Namespace
+	}
+	return id.Group < other.Group
+}
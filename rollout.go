@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRolloutTimeout is how long up apply waits for rollouts
+const DefaultRolloutTimeout = 5 * time.Minute
+
+// rolloutInterval is the interval of polling rollout status
+var rolloutInterval = 2 * time.Second
+
+// LogLines is the number of log lines shown for a crashlooping container
+const LogLines = 20
+
+// rollout is a workload whose rollout is watched
+type rollout struct {
+	config   *yaml.Node
+	id       resourceID
+	service  string
+	progress string // last printed progress
+	done     bool
+	live     gjson.Result
+}
+
+// isWorkload tells whether configs of kind are rolled out
+func isWorkload(kind string) bool {
+	return kind == "Deployment" || kind == "StatefulSet" || kind == "DaemonSet"
+}
+
+// rolloutStatus tells whether rollout of live workload of kind is done, like
+// kubectl rollout status does. progress describes the rollout if not done,
+// err is set if the rollout can not complete
+func rolloutStatus(kind string, live gjson.Result) (done bool, progress string, err error) {
+	status := live.Get("status")
+	if live.Get("metadata.generation").Int() > status.Get("observedGeneration").Int() {
+		return false, "waiting for the spec update to be observed", nil
+	}
+
+	switch kind {
+	case "Deployment":
+		for _, c := range status.Get("conditions").Array() {
+			if c.Get("type").String() == "Progressing" && c.Get("reason").String() == "ProgressDeadlineExceeded" {
+				return false, "", fmt.Errorf("progress deadline exceeded")
+			}
+		}
+		replicas := int64(1)
+		if r := live.Get("spec.replicas"); r.Exists() {
+			replicas = r.Int()
+		}
+		updated, available := status.Get("updatedReplicas").Int(), status.Get("availableReplicas").Int()
+		switch {
+		case updated < replicas:
+			return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas), nil
+		case status.Get("replicas").Int() > updated:
+			return false, fmt.Sprintf("%d old replicas pending termination", status.Get("replicas").Int()-updated), nil
+		case available < updated:
+			return false, fmt.Sprintf("%d of %d updated replicas available", available, updated), nil
+		}
+	case "StatefulSet":
+		replicas := int64(1)
+		if r := live.Get("spec.replicas"); r.Exists() {
+			replicas = r.Int()
+		}
+		ready := status.Get("readyReplicas").Int()
+		if ready < replicas {
+			return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+		}
+		if live.Get("spec.updateStrategy.type").String() != "OnDelete" && status.Get("updateRevision").String() != status.Get("currentRevision").String() {
+			return false, fmt.Sprintf("%d of %d replicas updated", status.Get("updatedReplicas").Int(), replicas), nil
+		}
+	case "DaemonSet":
+		desired := status.Get("desiredNumberScheduled").Int()
+		updated, available := status.Get("updatedNumberScheduled").Int(), status.Get("numberAvailable").Int()
+		switch {
+		case updated < desired:
+			return false, fmt.Sprintf("%d of %d pods updated", updated, desired), nil
+		case available < desired:
+			return false, fmt.Sprintf("%d of %d updated pods available", available, desired), nil
+		}
+	}
+	return true, "", nil
+}
+
+// watchRollouts waits until rollouts of workloads in configs are done,
+// printing their progress. When a rollout fails or timeout hits, events and
+// logs of crashlooping pods are printed
+func watchRollouts(k *kubeClient, configs []*yaml.Node, ns string, timeout time.Duration) error {
+	rollouts := make([]*rollout, 0)
+	for _, config := range configs {
+		id := getResourceID(config)
+		if !isWorkload(id.Kind) {
+			continue
+		}
+		id.Namespace = id.namespace(ns)
+		_, service := getConfigVersion(config)
+		rollouts = append(rollouts, &rollout{config: config, id: id, service: service})
+	}
+	if len(rollouts) == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := 0
+		for _, r := range rollouts {
+			if r.done {
+				continue
+			}
+			live, found, err := k.get(r.config, ns)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%s of service %s is deleted during rollout", r.id, r.service)
+			}
+			r.live = live
+			done, progress, err := rolloutStatus(r.id.Kind, live)
+			if err != nil {
+				showPodProblems(k, r)
+				return fmt.Errorf("rollout of %s of service %s failed: %v", r.id, r.service, err)
+			}
+			if done {
+				r.done = true
+				fmt.Println(color.GreenString("INFO: service %s: %s is rolled out", r.service, r.id))
+				continue
+			}
+			pending++
+			if progress != r.progress {
+				r.progress = progress
+				fmt.Printf("INFO: service %s: %s %s\n", r.service, r.id, progress)
+			}
+		}
+		if pending == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			failed := make([]string, 0)
+			for _, r := range rollouts {
+				if !r.done {
+					showPodProblems(k, r)
+					failed = append(failed, r.id.String())
+				}
+			}
+			return fmt.Errorf("rollout of %s timed out after %s", strings.Join(failed, ", "), timeout)
+		}
+		time.Sleep(rolloutInterval)
+	}
+}
+
+// showPodProblems prints events and logs of crashlooping pods of rollout r
+func showPodProblems(k *kubeClient, r *rollout) {
+	problems, err := podProblems(k, r.id.Namespace, r.live)
+	if err != nil {
+		fmt.Println(color.RedString("ERR: unable to get pods of %s: %v", r.id, err))
+		return
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+}
+
+// podProblems returns events and last logs of crashlooping pods of live
+// workload in namespace ns
+func podProblems(k *kubeClient, ns string, live gjson.Result) ([]string, error) {
+	labels := make([]string, 0)
+	live.Get("spec.selector.matchLabels").ForEach(func(key, value gjson.Result) bool {
+		labels = append(labels, key.String()+"="+value.String())
+		return true
+	})
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	sort.Strings(labels)
+
+	pods, err := k.read("/api/v1/namespaces/" + ns + "/pods?labelSelector=" + url.QueryEscape(strings.Join(labels, ",")))
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]string, 0)
+	for _, pod := range gjson.GetBytes(pods, "items").Array() {
+		name := pod.Get("metadata.name").String()
+		for _, c := range pod.Get("status.containerStatuses").Array() {
+			reason := c.Get("state.waiting.reason").String()
+			if reason != "CrashLoopBackOff" && reason != "Error" && c.Get("state.terminated.reason").String() != "Error" {
+				continue
+			}
+			container := c.Get("name").String()
+			problems = append(problems, color.RedString("ERR: pod %s container %s is crashlooping (%d restarts)", name, container, c.Get("restartCount").Int()))
+
+			events, err := k.read("/api/v1/namespaces/" + ns + "/events?fieldSelector=" + url.QueryEscape("involvedObject.name="+name))
+			if err == nil {
+				for _, e := range gjson.GetBytes(events, "items").Array() {
+					problems = append(problems, fmt.Sprintf("  event: %s %s: %s", e.Get("type").String(), e.Get("reason").String(), e.Get("message").String()))
+				}
+			}
+
+			// logs of the crashed container, not of the one waiting to restart
+			logs, err := k.read(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?container=%s&previous=true&tailLines=%d", ns, name, url.QueryEscape(container), LogLines))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("  no logs: %v", err))
+				continue
+			}
+			for _, line := range strings.Split(strings.TrimRight(string(logs), "\n"), "\n") {
+				problems = append(problems, "  log: "+line)
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRolloutStatus(t *testing.T) {
+	tests := []struct {
+		kind, live string
+		done       bool
+		progress   string
+		fails      bool
+	}{
+		{"Deployment", `{"metadata": {"generation": 2}, "status": {"observedGeneration": 1}}`, false, "waiting for the spec update to be observed", false},
+		{"Deployment", `{"spec": {"replicas": 3}, "status": {"replicas": 3, "updatedReplicas": 1}}`, false, "1 of 3 replicas updated", false},
+		{"Deployment", `{"spec": {"replicas": 2}, "status": {"replicas": 3, "updatedReplicas": 2}}`, false, "1 old replicas pending termination", false},
+		{"Deployment", `{"spec": {"replicas": 2}, "status": {"replicas": 2, "updatedReplicas": 2, "availableReplicas": 1}}`, false, "1 of 2 updated replicas available", false},
+		{"Deployment", `{"status": {"replicas": 1, "updatedReplicas": 1, "availableReplicas": 1}}`, true, "", false},
+		{"Deployment", `{"status": {"conditions": [{"type": "Progressing", "reason": "ProgressDeadlineExceeded"}]}}`, false, "", true},
+		{"StatefulSet", `{"spec": {"replicas": 2}, "status": {"readyReplicas": 1}}`, false, "1 of 2 replicas ready", false},
+		{"StatefulSet", `{"spec": {"replicas": 2}, "status": {"readyReplicas": 2, "updatedReplicas": 1, "currentRevision": "a", "updateRevision": "b"}}`, false, "1 of 2 replicas updated", false},
+		{"StatefulSet", `{"spec": {"replicas": 2}, "status": {"readyReplicas": 2, "currentRevision": "b", "updateRevision": "b"}}`, true, "", false},
+		{"DaemonSet", `{"status": {"desiredNumberScheduled": 3, "updatedNumberScheduled": 2}}`, false, "2 of 3 pods updated", false},
+		{"DaemonSet", `{"status": {"desiredNumberScheduled": 3, "updatedNumberScheduled": 3, "numberAvailable": 3}}`, true, "", false},
+	}
+	for _, test := range tests {
+		done, progress, err := rolloutStatus(test.kind, gjson.Parse(test.live))
+		if done != test.done || progress != test.progress || (err != nil) != test.fails {
+			t.Errorf("%s %s: got %v %q %v", test.kind, test.live, done, progress, err)
+		}
+	}
+}
+
+func parseConfigs(t *testing.T, deploy string) []*yaml.Node {
+	configs, err := parseDocs([]byte(deploy))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return configs
+}
+
+const rolloutDeploy = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: user
+  annotations: {version: "2", service: user}
+spec:
+  selector:
+    matchLabels: {app: user, tier: api}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: user
+  annotations: {version: "2", service: user}
+`
+
+func TestWatchRollouts(t *testing.T) {
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+	s.objects["/apis/apps/v1/namespaces/default/deployments/user"] = []byte(`{"metadata": {"name": "user", "generation": 2}, "status": {"observedGeneration": 2, "replicas": 1, "updatedReplicas": 1, "availableReplicas": 1}}`)
+
+	if err := watchRollouts(k, parseConfigs(t, rolloutDeploy), "default", time.Second); err != nil {
+		t.Fatalf("rollout is done, got %v", err)
+	}
+}
+
+func TestWatchRolloutsFails(t *testing.T) {
+	defer func(interval time.Duration) { rolloutInterval = interval }(rolloutInterval)
+	rolloutInterval = 10 * time.Millisecond
+	s := newFakeKubeServer(t)
+	defer s.Close()
+	k := makeKubeClient(s.URL, "Bearer secret", nil)
+	deployment := "/apis/apps/v1/namespaces/default/deployments/user"
+	s.objects[deployment] = []byte(`{"metadata": {"name": "user"}, "spec": {"selector": {"matchLabels": {"app": "user", "tier": "api"}}}, "status": {"replicas": 2, "updatedReplicas": 1}}`)
+	s.objects["/api/v1/namespaces/default/pods/user-1"] = []byte(`{"metadata": {"name": "user-1", "labels": {"app": "user", "tier": "api"}}, "status": {"containerStatuses": [{"name": "user", "restartCount": 4, "state": {"waiting": {"reason": "CrashLoopBackOff"}}}]}}`)
+	s.objects["/api/v1/namespaces/default/pods/user-2"] = []byte(`{"metadata": {"name": "user-2", "labels": {"app": "user", "tier": "api"}}, "status": {"containerStatuses": [{"name": "user", "state": {"running": {}}}]}}`)
+	s.objects["/api/v1/namespaces/default/pods/user-1/log"] = []byte("starting\npanic: no database\n")
+	s.objects["/api/v1/namespaces/default/events/user-1.1"] = []byte(`{"involvedObject": {"name": "user-1"}, "type": "Warning", "reason": "BackOff", "message": "Back-off restarting failed container"}`)
+	s.objects["/api/v1/namespaces/default/events/user-2.1"] = []byte(`{"involvedObject": {"name": "user-2"}, "type": "Normal", "reason": "Started", "message": "Started container"}`)
+
+	err := watchRollouts(k, parseConfigs(t, rolloutDeploy), "default", 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("rollout should time out, got %v", err)
+	}
+
+	live, _, _ := k.get(parseConfigs(t, rolloutDeploy)[0], "default")
+	problems, err := podProblems(k, "default", live)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected := []string{
+		"ERR: pod user-1 container user is crashlooping (4 restarts)",
+		"  event: Warning BackOff: Back-off restarting failed container",
+		"  log: starting",
+		"  log: panic: no database",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("wrong problems, got %q", problems)
+	}
+
+	s.objects[deployment] = []byte(`{"metadata": {"name": "user"}, "status": {"conditions": [{"type": "Progressing", "reason": "ProgressDeadlineExceeded"}]}}`)
+	err = watchRollouts(k, parseConfigs(t, rolloutDeploy), "default", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "progress deadline exceeded") {
+		t.Fatalf("rollout should fail, got %v", err)
+	}
+}
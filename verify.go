@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/fatih/color"
+	"github.com/urfave/cli"
+)
+
+// verifyLock checks consistency of up.yaml, up-lock.yaml, the service cache
+// and modification files, returns found problems
+func verifyLock(upv, lock map[string]*Version, h *httpClient) []string {
+	problems := make([]string, 0)
+	report := func(sname, format string, a ...interface{}) {
+		problems = append(problems, "service "+sname+": "+fmt.Sprintf(format, a...))
+	}
+
+	for sname, sver := range upv {
+		locked := lock[sname]
+		if locked == nil {
+			report(sname, "not locked, try up upgrade %s", sname)
+			continue
+		}
+		if locked.Repo != sver.Repo || locked.Host != sver.Host {
+			report(sname, "locked repo %s is not %s in %s", locked.Repo, sver.Repo, UpPath)
+		}
+		if locked.Branch != sver.Branch {
+			report(sname, "locked branch %q is not %q in %s", locked.Branch, sver.Branch, UpPath)
+		}
+		if sver.Commit != "" && locked.Commit != sver.Commit {
+			report(sname, "locked commit %s is not %s in %s", locked.Commit, sver.Commit, UpPath)
+		}
+	}
+
+	for sname, locked := range lock {
+		if upv[sname] == nil {
+			report(sname, "locked but not found in %s", UpPath)
+			continue
+		}
+
+		deploy, err := loadDeploy(sname, locked)
+		if err != nil {
+			report(sname, "%v", err)
+			continue
+		}
+		if locked.DeploySum == "" {
+			report(sname, "no sha256 of deploy.yaml in %s, try up upgrade %s", LockPath, sname)
+		} else if sha256sum(deploy) != locked.DeploySum {
+			report(sname, "cached deployment does not match sha256 in %s", LockPath)
+		}
+
+		if body, err := loadService(sname, locked); err != nil {
+			report(sname, "%v", err)
+		} else if err := checkService(sname, locked, body); err != nil {
+			report(sname, "%s: %v", servicePath(locked.Cache), err)
+		}
+		if err := verifyService(sname, locked, h); err != nil {
+			report(sname, "%v", err)
+		}
+
+		unuseds, err := unusedModifications(readDeployModification(overlayPath(sname, "")), deploy)
+		if err != nil {
+			report(sname, "%v", err)
+		}
+		for _, unused := range unuseds {
+			report(sname, "modification %s.yaml references %s which is not in deploy.yaml", sname, unused)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// verifyService fetches service.yaml at the locked commit from the source host
+// and checks it like checkService does
+func verifyService(sname string, sver *Version, h *httpClient) error {
+	provider, err := getProvider(sver.Host, sver.Repo, h)
+	if err != nil {
+		return err
+	}
+	body, err := provider.GetFile(sver.Repo, sver.Commit, "service.yaml")
+	if err != nil {
+		return err
+	}
+	return checkService(sname, sver, body)
+}
+
+// checkService checks service.yaml body of service sname against its hash, and
+// its name and version against the ones recorded in up-lock.yaml
+func checkService(sname string, sver *Version, body []byte) error {
+	if sver.ServiceSum == "" {
+		return fmt.Errorf("no sha256 of service.yaml in %s, try up upgrade %s", LockPath, sname)
+	}
+	if sha256sum(body) != sver.ServiceSum {
+		return fmt.Errorf("service.yaml does not match sha256 in %s", LockPath)
+	}
+	service, err := unmarshalService(sver.Repo, body)
+	if err != nil {
+		return err
+	}
+	if service.Name != sver.Name {
+		return fmt.Errorf("name in service.yaml is %q, but %q in %s", service.Name, sver.Name, LockPath)
+	}
+	if strconv.Itoa(service.Version) != sver.Version {
+		return fmt.Errorf("version in service.yaml is %d, but %s in %s", service.Version, sver.Version, LockPath)
+	}
+	return nil
+}
+
+// unusedModifications returns configs (kind/name) in modification, or targets
+// of patches, which don't match any config in deploy
+func unusedModifications(modification, deploy []byte) ([]string, error) {
+	unuseds := make([]string, 0)
+	mdocs, err := parseDocs(modification)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modification file: %v", err)
+	}
+	ddocs, err := parseDocs(deploy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deploy.yaml: %v", err)
+	}
+	for _, y := range mdocs {
+		id := getResourceID(y)
+		if isPatch(y) {
+			patch, err := parsePatch(y)
+			if err != nil {
+				return nil, fmt.Errorf("invalid patch: %v", err)
+			}
+			id = patch.Target
+		}
+		if id.Name == "" && id.Kind == "" {
+			continue
+		}
+
+		found := false
+		for _, d := range ddocs {
+			if id.matches(getResourceID(d), DefaultNamespace) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unuseds = append(unuseds, id.String())
+		}
+	}
+	return unuseds, nil
+}
+
+func verify(c *cli.Context) error {
+	upv, err := readVersions(UpPath)
+	if err != nil {
+		return cli.NewExitError(err, -70)
+	}
+	lock, err := readLock(LockPath)
+	if err != nil {
+		return cli.NewExitError(err, -70)
+	}
+
+	problems := verifyLock(upv, lock, newHTTPClient(c.Int("retries")))
+	for _, p := range problems {
+		fmt.Println(color.RedString("ERR: ") + p)
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("found %d problems", len(problems)), -71)
+	}
+	fmt.Println(color.GreenString("%d services verified.", len(lock)))
+	return nil
+}
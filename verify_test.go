@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestVerifyLock(t *testing.T) {
+	dir, clean := makeTempDir(t)
+	defer clean()
+	defer useHome(t, dir)()
+
+	repo := makeGitRepo(t, dir, "user", map[string]string{
+		"service.yaml": "name: user\nversion: 1\n",
+		"deploy.yaml":  "kind: Service\nmetadata:\n  name: user\n",
+	})
+	defer chdir(t, dir)()
+	ioutil.WriteFile("up.yaml", []byte("user:\n  repo: "+repo+"\n  branch: master\n"), 0644)
+	ioutil.WriteFile("user.yaml", []byte("kind: Service\nmetadata:\n  name: user\n"), 0644)
+	if err := upgrade(newTestContext(t, "upgrade")); err != nil {
+		t.Fatalf("upgrade error: %v", err)
+	}
+
+	upv, _ := readVersions(UpPath)
+	lock, _ := readLock(LockPath)
+	if problems := verifyLock(upv, lock, nil); len(problems) != 0 {
+		t.Fatalf("should have no problem, got %v", problems)
+	}
+	if err := verify(newTestContext(t, "verify")); err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+
+	upv["user"].Branch = "dev"
+	upv["account"] = &Version{Repo: "subiz/account"}
+	lock["billing"] = &Version{Repo: "subiz/billing"}
+	ioutil.WriteFile("user.yaml", []byte("kind: Deployment\nmetadata:\n  name: user\n"), 0644)
+	problems := verifyLock(upv, lock, nil)
+	expects := []string{
+		"service account: not locked",
+		"service billing: locked but not found",
+		`service user: locked branch "master" is not "dev"`,
+		"service user: modification user.yaml references Deployment/user",
+	}
+	if len(problems) != len(expects) {
+		t.Fatalf("should have %d problems, got %v", len(expects), problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p, expects[i]) {
+			t.Fatalf("expect %s, got %s", expects[i], p)
+		}
+	}
+}
+
+func TestUnusedModificationsInvalidDeploy(t *testing.T) {
+	modification := []byte("kind: Service\nmetadata:\n  name: user\n")
+	if _, err := unusedModifications(modification, []byte("kind: [Service\n")); err == nil {
+		t.Fatalf("invalid deploy.yaml should fail")
+	}
+	unuseds, err := unusedModifications(modification, []byte("kind: Deployment\nmetadata:\n  name: user\n"))
+	if err != nil || len(unuseds) != 1 || unuseds[0] != "Service/user" {
+		t.Fatalf("should report Service/user, got %v %v", unuseds, err)
+	}
+}